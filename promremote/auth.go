@@ -0,0 +1,246 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BasicAuth configures HTTP basic authentication. Exactly one of Password or
+// PasswordFile may be set.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// PasswordFile is read on every request and reloaded whenever it changes.
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+func (c Config) validateAuth() error {
+	configured := 0
+	if c.BasicAuth != nil {
+		configured++
+	}
+	if c.BearerToken != "" {
+		configured++
+	}
+	if c.BearerTokenFile != "" {
+		configured++
+	}
+	if c.OAuth2 != nil {
+		configured++
+	}
+	if c.SigV4 != nil {
+		configured++
+	}
+	if configured > 1 {
+		return errors.New("at most one of basic auth, bearer token, bearer token file, oauth2 and sigv4 should be set")
+	}
+
+	if c.BasicAuth != nil {
+		if c.BasicAuth.Username == "" {
+			return errors.New("basic auth username should not be blank")
+		}
+		if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+			return errors.New("at most one of basic auth password and password file should be set")
+		}
+	}
+
+	if c.OAuth2 != nil {
+		if err := c.OAuth2.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.SigV4 != nil {
+		if err := c.SigV4.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newHTTPClient returns the HTTP client described by the config, wrapping its
+// transport to authenticate requests if auth is configured.
+func (c Config) newHTTPClient() (*http.Client, error) {
+	httpClient := &http.Client{
+		Timeout: c.HTTPClientTimeout,
+	}
+
+	if c.HTTPClient != nil {
+		httpClient = c.HTTPClient
+	} else if c.TLS != nil {
+		transport, err := newTLSRoundTripper(*c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = transport
+	}
+
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	authorize, err := c.authorizer(&http.Client{Transport: next, Timeout: httpClient.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	if authorize == nil {
+		return httpClient, nil
+	}
+
+	authClient := *httpClient
+	authClient.Transport = &authRoundTripper{next: next, authorize: authorize}
+
+	return &authClient, nil
+}
+
+// authType returns the name of the configured auth method, for logging.
+func (c Config) authType() string {
+	switch {
+	case c.BasicAuth != nil:
+		return "basic"
+	case c.BearerToken != "" || c.BearerTokenFile != "":
+		return "bearer"
+	case c.OAuth2 != nil:
+		return "oauth2"
+	case c.SigV4 != nil:
+		return "sigv4"
+	default:
+		return "none"
+	}
+}
+
+// authorizer returns the function setting the credentials of requests, or nil
+// if auth is not configured. Credentials that have to be fetched are fetched
+// with the given unauthenticated client.
+func (c Config) authorizer(httpClient *http.Client) (func(*http.Request) error, error) {
+	switch {
+	case c.BasicAuth != nil:
+		username, password := c.BasicAuth.Username, newSecret(c.BasicAuth.Password, c.BasicAuth.PasswordFile)
+		return func(req *http.Request) error {
+			p, err := password.get()
+			if err != nil {
+				return err
+			}
+			req.SetBasicAuth(username, p)
+			return nil
+		}, nil
+	case c.BearerToken != "" || c.BearerTokenFile != "":
+		token := newSecret(c.BearerToken, c.BearerTokenFile)
+		return func(req *http.Request) error {
+			t, err := token.get()
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+t)
+			return nil
+		}, nil
+	case c.OAuth2 != nil:
+		return newOAuth2Authorizer(*c.OAuth2, httpClient).authorize, nil
+	case c.SigV4 != nil:
+		signer, err := newSigV4Signer(*c.SigV4)
+		if err != nil {
+			return nil, err
+		}
+		return signer.authorize, nil
+	default:
+		return nil, nil
+	}
+}
+
+// authRoundTripper sets the Authorization header of requests that do not
+// already carry one, e.g. through WriteOptions.Headers.
+type authRoundTripper struct {
+	next      http.RoundTripper
+	authorize func(*http.Request) error
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if err := rt.authorize(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// secret is a credential given either inline or as the path of a file holding it.
+// Files are reloaded when their modification time or size changes, so rotated
+// credentials such as Kubernetes service account tokens are picked up.
+type secret struct {
+	value string
+	path  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	loaded  bool
+}
+
+func newSecret(value, path string) *secret {
+	return &secret{value: value, path: path}
+}
+
+func (s *secret) get() (string, error) {
+	if s.path == "" {
+		return s.value, nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read credentials file: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loaded && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.value, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read credentials file: %v", err)
+	}
+
+	s.value = strings.TrimSpace(string(data))
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.loaded = true
+
+	return s.value, nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAuthTestServer returns a server recording the Authorization header of every request.
+func newAuthTestServer(t *testing.T) (*httptest.Server, func() []string) {
+	var (
+		mu      sync.Mutex
+		headers []string
+	)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+	}))
+	t.Cleanup(testServer.Close)
+
+	return testServer, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), headers...)
+	}
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	testServer, headers := newAuthTestServer(t)
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("s3cret\n"), 0600))
+
+	for _, basicAuth := range []BasicAuth{
+		{Username: "user", Password: "s3cret"},
+		{Username: "user", PasswordFile: passwordFile},
+	} {
+		c, err := NewClient(NewConfig(
+			WriteURLOption(testServer.URL),
+			BasicAuthOption(basicAuth),
+		))
+		require.NoError(t, err)
+
+		_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+		require.NoError(t, writeErr)
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("user", "s3cret")
+	assert.Equal(t, []string{req.Header.Get("Authorization"), req.Header.Get("Authorization")}, headers())
+}
+
+func TestClientBearerToken(t *testing.T) {
+	testServer, headers := newAuthTestServer(t)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		BearerTokenOption("token"),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{
+		Headers: map[string]string{"Authorization": "Bearer override"},
+	})
+	require.NoError(t, writeErr)
+
+	assert.Equal(t, []string{"Bearer token", "Bearer override"}, headers())
+}
+
+func TestClientBearerTokenFileReload(t *testing.T) {
+	testServer, headers := newAuthTestServer(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first"), 0600))
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		BearerTokenFileOption(tokenFile),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("second\n"), 0600))
+	require.NoError(t, os.Chtimes(tokenFile, time.Now(), time.Now().Add(time.Minute)))
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	assert.Equal(t, []string{"Bearer first", "Bearer second"}, headers())
+
+	require.NoError(t, os.Remove(tokenFile))
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	assert.Error(t, writeErr)
+}
+
+func TestReaderBearerToken(t *testing.T) {
+	var header string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer testServer.Close()
+
+	r, err := NewReader(NewConfig(
+		ReadURLOption(testServer.URL),
+		BearerTokenOption("token"),
+	))
+	require.NoError(t, err)
+
+	_, readErr := r.Read(context.Background(), testQuery(), ReadOptions{})
+	require.Error(t, readErr)
+	assert.Equal(t, "Bearer token", header)
+}
+
+func TestValidateConfigAuth(t *testing.T) {
+	tests := [][]ConfigOption{
+		{BasicAuthOption(BasicAuth{Password: "s3cret"})},
+		{BasicAuthOption(BasicAuth{Username: "user", Password: "s3cret", PasswordFile: "/password"})},
+		{BasicAuthOption(BasicAuth{Username: "user"}), BearerTokenOption("token")},
+		{BearerTokenOption("token"), BearerTokenFileOption("/token")},
+	}
+
+	for _, opts := range tests {
+		_, err := NewClient(NewConfig(opts...))
+		require.Error(t, err)
+
+		_, err = NewReader(NewConfig(opts...))
+		require.Error(t, err)
+	}
+}
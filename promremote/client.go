@@ -26,27 +26,59 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	// DefaultRemoteWrite is the default Prom remote write endpoint in m3coordinator.
 	DefaultRemoteWrite = "http://localhost:7201/api/v1/prom/remote/write"
 
+	// DefaultRemoteRead is the default Prom remote read endpoint in m3coordinator.
+	DefaultRemoteRead = "http://localhost:7201/api/v1/prom/remote/read"
+
 	defaulHTTPClientTimeout = 30 * time.Second
 	defaultUserAgent        = "promremote-go/1.0.0"
+
+	remoteWriteVersionHeader    = "X-Prometheus-Remote-Write-Version"
+	remoteWriteVersion1Header   = "0.1.0"
+	remoteWriteVersion20Header  = "2.0.0"
+	appProtoContentType         = "application/x-protobuf"
+	appProtoContentTypeV2Suffix = ";proto=" + string(WriteProtoMsgV2)
+)
+
+// WriteProtoMsg is the protobuf message used to encode remote write requests.
+type WriteProtoMsg string
+
+const (
+	// WriteProtoMsgV1 is the Remote Write 1.0 (0.1.0) prometheus.WriteRequest message.
+	WriteProtoMsgV1 WriteProtoMsg = "prometheus.WriteRequest"
+	// WriteProtoMsgV2 is the Remote Write 2.0 io.prometheus.write.v2.Request message.
+	WriteProtoMsgV2 WriteProtoMsg = "io.prometheus.write.v2.Request"
 )
 
 // DefaultConfig represents the default configuration used to construct a client.
 var DefaultConfig = Config{
 	WriteURL:          DefaultRemoteWrite,
+	ReadURL:           DefaultRemoteRead,
 	HTTPClientTimeout: defaulHTTPClientTimeout,
 	UserAgent:         defaultUserAgent,
+	WriteProtoMsg:     WriteProtoMsgV1,
+	Retry:             DefaultRetryConfig,
+	Compression:       CompressionSnappy,
 }
 
 // Label is a metric label.
@@ -55,10 +87,26 @@ type Label struct {
 	Value string
 }
 
-// TimeSeries are made of labels and a datapoint.
+// TimeSeries are made of labels and one or more datapoints.
 type TimeSeries struct {
 	Labels    []Label
 	Datapoint Datapoint
+
+	// Datapoints holds multiple datapoints of the series, which are sent
+	// sorted by timestamp. If set, Datapoint is ignored.
+	Datapoints []Datapoint
+
+	// Histograms holds native histogram samples of the series, which are sent
+	// sorted by timestamp. A series made only of histograms leaves Datapoint unset.
+	Histograms []HistogramDatapoint
+
+	// Metadata describes the metric the series belongs to. Remote Write 1.0
+	// requests carry it once per metric family rather than per series.
+	Metadata Metadata
+
+	// CreatedTimestamp is the time the series (e.g. a counter) was created
+	// or last reset. It is only sent with Remote Write 2.0 requests.
+	CreatedTimestamp time.Time
 }
 
 // TSList is a slice of TimeSeries.
@@ -68,6 +116,28 @@ type TSList []TimeSeries
 type Datapoint struct {
 	Timestamp time.Time
 	Value     float64
+
+	// Exemplars are sent along with the series of the datapoint.
+	Exemplars []Exemplar
+}
+
+// An Exemplar is an example observation, such as a trace ID, attached to a datapoint.
+// If Timestamp is not set, the timestamp of the datapoint is used.
+type Exemplar struct {
+	Labels    []Label
+	Value     float64
+	Timestamp time.Time
+}
+
+// A HistogramDatapoint is a single native histogram reported at a given time.
+// Exactly one of Histogram or FloatHistogram must be set.
+type HistogramDatapoint struct {
+	Timestamp      time.Time
+	Histogram      *histogram.Histogram
+	FloatHistogram *histogram.FloatHistogram
+
+	// Exemplars are sent along with the series of the histogram.
+	Exemplars []Exemplar
 }
 
 // Client is used to write timeseries data to a Prom remote write endpoint
@@ -81,6 +151,8 @@ type Client interface {
 	) (WriteResult, WriteError)
 
 	// WriteTimeSeries converts the []TimeSeries to Protobuf then writes it to the specified endpoint.
+	// The protobuf message is selected by Config.WriteProtoMsg, and labels are
+	// relabeled and validated according to the config.
 	WriteTimeSeries(
 		ctx context.Context,
 		ts TSList,
@@ -88,15 +160,46 @@ type Client interface {
 	) (WriteResult, WriteError)
 }
 
+// V2Writer is implemented by the clients of this package that can write
+// prebuilt Remote Write 2.0 requests.
+type V2Writer interface {
+	// WriteProtoV2 writes the Remote Write 2.0 proto Request to the specified endpoint.
+	// If the endpoint answers 415 Unsupported Media Type the request is resent as a
+	// Remote Write 1.0 WriteRequest, and all later Remote Write 2.0 writes are downgraded.
+	WriteProtoV2(
+		ctx context.Context,
+		req *writev2.Request,
+		opts WriteOptions,
+	) (WriteResult, WriteError)
+}
+
+// MetadataWriter is implemented by the clients of this package that can write
+// metric metadata on its own.
+type MetadataWriter interface {
+	// WriteMetadata writes the metric metadata to the specified endpoint without any series.
+	// Remote Write 2.0 has no such message, so it is always sent as a Remote Write 1.0 WriteRequest.
+	WriteMetadata(
+		ctx context.Context,
+		md MetadataList,
+		opts WriteOptions,
+	) (WriteResult, WriteError)
+}
+
 // WriteOptions specifies additional write options.
 type WriteOptions struct {
 	// Headers to append or override the outgoing headers.
 	Headers map[string]string
+
+	// Compression, if not blank, overrides the compression set in the config.
+	Compression Compression
 }
 
 // WriteResult returns the successful HTTP status code.
 type WriteResult struct {
 	StatusCode int
+
+	// InvalidSeries are the series dropped by lenient label validation.
+	InvalidSeries []SeriesError
 }
 
 // WriteError is an error that can also return the HTTP status code
@@ -111,6 +214,9 @@ type Config struct {
 	// WriteURL is the URL which the client uses to write to m3coordinator.
 	WriteURL string `yaml:"writeURL"`
 
+	// ReadURL is the URL which the reader uses to read from m3coordinator.
+	ReadURL string `yaml:"readURL"`
+
 	//HTTPClientTimeout is the timeout that is set for the client.
 	HTTPClientTimeout time.Duration `yaml:"httpClientTimeout"`
 
@@ -119,6 +225,65 @@ type Config struct {
 
 	// UserAgent is the `User-Agent` header in the request.
 	UserAgent string `yaml:"userAgent"`
+
+	// WriteProtoMsg is the protobuf message WriteTimeSeries encodes series with.
+	WriteProtoMsg WriteProtoMsg `yaml:"writeProtoMsg"`
+
+	// Retry configures how failed writes are retried.
+	Retry RetryConfig `yaml:"retry"`
+
+	// Compression is the algorithm write requests are compressed with.
+	Compression Compression `yaml:"compression"`
+
+	// LabelValidation is the mode WriteTimeSeries validates labels in. If blank,
+	// labels are sent verbatim.
+	LabelValidation LabelValidation `yaml:"labelValidation"`
+
+	// ExternalLabels are added to every written series. As in Prometheus, a
+	// label of the series takes precedence over an external label of the same
+	// name, unless its value is empty.
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+
+	// WriteRelabelConfigs are applied, with Prometheus relabel_config semantics,
+	// to every written series after external labels are added. Series dropped
+	// by relabeling are not sent.
+	WriteRelabelConfigs []*relabel.Config `yaml:"writeRelabelConfigs"`
+
+	// BasicAuth, if not nil, sets the basic auth credentials of every request.
+	BasicAuth *BasicAuth `yaml:"basicAuth"`
+
+	// BearerToken is sent as a bearer token in the `Authorization` header.
+	BearerToken string `yaml:"bearerToken"`
+
+	// BearerTokenFile is the path of a file holding the bearer token. It is
+	// reloaded whenever it changes.
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+
+	// OAuth2, if not nil, authenticates requests with access tokens obtained
+	// through the OAuth2 client credentials flow.
+	OAuth2 *OAuth2 `yaml:"oauth2"`
+
+	// SigV4, if not nil, signs requests with AWS Signature Version 4.
+	SigV4 *SigV4 `yaml:"sigv4"`
+
+	// TLS, if not nil, configures TLS connections of the constructed HTTP
+	// client. It cannot be combined with HTTPClient.
+	TLS *TLSConfig `yaml:"tls"`
+
+	// Metrics, if not nil, records the self-instrumentation metrics of the client.
+	Metrics *Metrics `yaml:"-"`
+
+	// TracerProvider creates the tracer of the spans of write requests. If
+	// nil, the global tracer provider is used.
+	TracerProvider trace.TracerProvider `yaml:"-"`
+
+	// Propagator injects the trace context into the headers of write
+	// requests. If nil, the global propagator is used.
+	Propagator propagation.TextMapPropagator `yaml:"-"`
+
+	// Logger, if not nil, logs retries, rejected requests, dropped series and
+	// config decisions. The client is silent otherwise.
+	Logger *slog.Logger `yaml:"-"`
 }
 
 // ConfigOption defines a config option that can be used when constructing a client.
@@ -147,6 +312,38 @@ func (c Config) validate() error {
 		return errors.New("User-Agent should not be blank")
 	}
 
+	if err := c.WriteProtoMsg.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Compression.validate(); err != nil {
+		return err
+	}
+
+	if err := c.LabelValidation.validate(); err != nil {
+		return err
+	}
+
+	if err := validateExternalLabels(c.ExternalLabels); err != nil {
+		return err
+	}
+
+	if err := validateRelabelConfigs(c.WriteRelabelConfigs); err != nil {
+		return err
+	}
+
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -157,6 +354,13 @@ func WriteURLOption(writeURL string) ConfigOption {
 	}
 }
 
+// ReadURLOption sets the URL which the reader uses to read from m3coordinator.
+func ReadURLOption(readURL string) ConfigOption {
+	return func(c *Config) {
+		c.ReadURL = readURL
+	}
+}
+
 // HTTPClientTimeoutOption sets the timeout that is set for the client.
 func HTTPClientTimeoutOption(httpClientTimeout time.Duration) ConfigOption {
 	return func(c *Config) {
@@ -178,10 +382,140 @@ func UserAgent(userAgent string) ConfigOption {
 	}
 }
 
+// WriteProtoMsgOption sets the protobuf message WriteTimeSeries encodes series with.
+func WriteProtoMsgOption(msg WriteProtoMsg) ConfigOption {
+	return func(c *Config) {
+		c.WriteProtoMsg = msg
+	}
+}
+
+// RetryOption sets how failed writes are retried.
+func RetryOption(retry RetryConfig) ConfigOption {
+	return func(c *Config) {
+		c.Retry = retry
+	}
+}
+
+// CompressionOption sets the algorithm write requests are compressed with.
+func CompressionOption(compression Compression) ConfigOption {
+	return func(c *Config) {
+		c.Compression = compression
+	}
+}
+
+// LabelValidationOption sets the mode WriteTimeSeries validates labels in.
+func LabelValidationOption(labelValidation LabelValidation) ConfigOption {
+	return func(c *Config) {
+		c.LabelValidation = labelValidation
+	}
+}
+
+// ExternalLabelsOption sets the labels added to every written series.
+func ExternalLabelsOption(externalLabels map[string]string) ConfigOption {
+	return func(c *Config) {
+		c.ExternalLabels = externalLabels
+	}
+}
+
+// WriteRelabelConfigsOption sets the relabel configs applied to every written series.
+func WriteRelabelConfigsOption(cfgs ...*relabel.Config) ConfigOption {
+	return func(c *Config) {
+		c.WriteRelabelConfigs = cfgs
+	}
+}
+
+// BasicAuthOption sets the basic auth credentials of every request.
+func BasicAuthOption(basicAuth BasicAuth) ConfigOption {
+	return func(c *Config) {
+		c.BasicAuth = &basicAuth
+	}
+}
+
+// BearerTokenOption sets the bearer token sent in the `Authorization` header.
+func BearerTokenOption(token string) ConfigOption {
+	return func(c *Config) {
+		c.BearerToken = token
+	}
+}
+
+// BearerTokenFileOption sets the path of a file holding the bearer token.
+func BearerTokenFileOption(path string) ConfigOption {
+	return func(c *Config) {
+		c.BearerTokenFile = path
+	}
+}
+
+// OAuth2Option sets the OAuth2 client credentials requests are authenticated with.
+func OAuth2Option(oauth2 OAuth2) ConfigOption {
+	return func(c *Config) {
+		c.OAuth2 = &oauth2
+	}
+}
+
+// SigV4Option sets the AWS Signature Version 4 config requests are signed with.
+func SigV4Option(sigV4 SigV4) ConfigOption {
+	return func(c *Config) {
+		c.SigV4 = &sigV4
+	}
+}
+
+// TLSOption sets the TLS config of the constructed HTTP client.
+func TLSOption(tlsConfig TLSConfig) ConfigOption {
+	return func(c *Config) {
+		c.TLS = &tlsConfig
+	}
+}
+
+// MetricsOption sets the metrics the client records its self-instrumentation metrics in.
+func MetricsOption(metrics *Metrics) ConfigOption {
+	return func(c *Config) {
+		c.Metrics = metrics
+	}
+}
+
+// TracerProviderOption sets the tracer provider of the spans of write requests.
+func TracerProviderOption(tp trace.TracerProvider) ConfigOption {
+	return func(c *Config) {
+		c.TracerProvider = tp
+	}
+}
+
+// PropagatorOption sets the propagator injecting the trace context into write requests.
+func PropagatorOption(p propagation.TextMapPropagator) ConfigOption {
+	return func(c *Config) {
+		c.Propagator = p
+	}
+}
+
+// LoggerOption sets the logger of the client.
+func LoggerOption(logger *slog.Logger) ConfigOption {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+var (
+	_ V2Writer       = (*client)(nil)
+	_ MetadataWriter = (*client)(nil)
+)
+
 type client struct {
-	writeURL   string
-	httpClient *http.Client
-	userAgent  string
+	writeURL       string
+	endpointURL    string
+	httpClient     *http.Client
+	userAgent      string
+	writeProtoMsg  WriteProtoMsg
+	retry          RetryConfig
+	compression    Compression
+	validation     LabelValidation
+	labelProcessor labelProcessor
+	metrics        *endpointMetrics
+	tracer         trace.Tracer
+	propagator     propagation.TextMapPropagator
+	logger         *slog.Logger
+
+	// downgraded is set once the endpoint rejected a Remote Write 2.0 request.
+	downgraded atomic.Bool
 }
 
 // NewClient creates a new remote write coordinator client.
@@ -190,26 +524,155 @@ func NewClient(c Config) (Client, error) {
 		return nil, err
 	}
 
-	httpClient := &http.Client{
-		Timeout: c.HTTPClientTimeout,
+	httpClient, err := c.newHTTPClient()
+	if err != nil {
+		return nil, err
 	}
 
-	if c.HTTPClient != nil {
-		httpClient = c.HTTPClient
+	tp := c.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	propagator := c.Propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
 	}
 
+	// The URL may carry basic auth credentials, which must not end up in
+	// spans, metric labels or logs.
+	endpointURL := redactURL(c.WriteURL)
+
+	logger := loggerOrDiscard(c.Logger).With("url", endpointURL)
+	logger.Debug("Created remote write client",
+		"proto_msg", c.WriteProtoMsg,
+		"compression", c.Compression,
+		"max_attempts", c.Retry.MaxAttempts,
+		"label_validation", c.LabelValidation,
+		"relabel_configs", len(c.WriteRelabelConfigs),
+		"auth", c.authType(),
+	)
+
 	return &client{
-		writeURL:   c.WriteURL,
-		httpClient: httpClient,
+		writeURL:      c.WriteURL,
+		endpointURL:   endpointURL,
+		httpClient:    httpClient,
+		writeProtoMsg: c.WriteProtoMsg,
+		retry:         c.Retry,
+		compression:   c.Compression,
+		validation:    c.LabelValidation,
+		labelProcessor: labelProcessor{
+			externalLabels: sortedLabels(c.ExternalLabels),
+			relabelConfigs: c.WriteRelabelConfigs,
+		},
+		metrics:    c.Metrics.endpoint(endpointURL),
+		tracer:     tp.Tracer(tracerName),
+		propagator: propagator,
+		logger:     logger,
 	}, nil
 }
 
+// redactURL returns rawURL without its userinfo.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+
+	return u.String()
+}
+
 func (c *client) WriteTimeSeries(
 	ctx context.Context,
 	seriesList TSList,
 	opts WriteOptions,
 ) (WriteResult, WriteError) {
-	return c.WriteProto(ctx, seriesList.toPromWriteRequest(), opts)
+	processed, invalid := c.processSeries(seriesList)
+	if len(invalid) > 0 {
+		c.logger.Warn("Dropped series with invalid labels",
+			"series", len(invalid),
+			"mode", c.validation,
+			"first_err", invalid[0].Err,
+		)
+	}
+	if len(invalid) > 0 && c.validation == LabelValidationStrict {
+		return WriteResult{}, writeError{err: &LabelValidationError{Series: invalid}}
+	}
+	if len(processed) == 0 && len(seriesList) > 0 {
+		return WriteResult{InvalidSeries: invalid}, nil
+	}
+
+	result, writeErr := c.writeTimeSeries(ctx, processed, opts)
+	result.InvalidSeries = invalid
+
+	return result, writeErr
+}
+
+// processSeries returns the series with external labels added, relabeled and
+// validated, leaving out the ones dropped by relabeling and the invalid ones.
+func (c *client) processSeries(seriesList TSList) (TSList, []SeriesError) {
+	if !c.labelProcessor.enabled() && c.validation == "" {
+		return seriesList, nil
+	}
+
+	var (
+		processed = make(TSList, 0, len(seriesList))
+		invalid   []SeriesError
+		dropped   int
+	)
+	for i, ts := range seriesList {
+		labels, keep := c.labelProcessor.process(ts.Labels)
+		if !keep {
+			dropped++
+			continue
+		}
+
+		if c.validation != "" {
+			var err error
+			if labels, err = normaliseLabels(labels); err != nil {
+				invalid = append(invalid, SeriesError{Index: i, Labels: ts.Labels, Err: err})
+				continue
+			}
+		}
+
+		ts.Labels = labels
+		processed = append(processed, ts)
+	}
+
+	if dropped > 0 {
+		c.logger.Debug("Dropped series by relabeling", "series", dropped)
+	}
+
+	return processed, invalid
+}
+
+func (c *client) writeTimeSeries(
+	ctx context.Context,
+	seriesList TSList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	if c.writeProtoMsg == WriteProtoMsgV2 && !c.downgraded.Load() {
+		req, err := seriesList.toWriteV2Request()
+		if err != nil {
+			return WriteResult{}, writeError{err: err}
+		}
+		return c.writeProtoV2(ctx, req, opts)
+	}
+
+	promWR, err := seriesList.toPromWriteRequest()
+	if err != nil {
+		return WriteResult{}, writeError{err: err}
+	}
+
+	return c.writeProto(ctx, promWR, opts)
+}
+
+func (c *client) WriteMetadata(
+	ctx context.Context,
+	md MetadataList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	return c.writeProto(ctx, md.toPromWriteRequest(), opts)
 }
 
 func (c *client) WriteProto(
@@ -217,13 +680,165 @@ func (c *client) WriteProto(
 	promWR *prompb.WriteRequest,
 	opts WriteOptions,
 ) (WriteResult, WriteError) {
-	var result WriteResult
+	processed := c.labelProcessor.processPromWriteRequest(promWR)
+	// Like WriteTimeSeries, nothing is sent once relabeling dropped every series.
+	if len(processed.Timeseries) == 0 && len(promWR.Timeseries) > 0 && len(processed.Metadata) == 0 {
+		return WriteResult{}, nil
+	}
+
+	return c.writeProto(ctx, processed, opts)
+}
+
+// writeProto writes the request, whose series already carry the external labels.
+func (c *client) writeProto(
+	ctx context.Context,
+	promWR *prompb.WriteRequest,
+	opts WriteOptions,
+) (result WriteResult, writeErr WriteError) {
+	stats := promWriteRequestStats(promWR)
+	ctx, span := c.startWriteSpan(ctx, WriteProtoMsgV1, stats)
+	defer func() { endWriteSpan(span, result, writeErr) }()
+
 	data, err := proto.Marshal(promWR)
 	if err != nil {
-		return result, writeError{err: fmt.Errorf("unable to marshal protobuf: %v", err)}
+		return WriteResult{}, writeError{err: fmt.Errorf("unable to marshal protobuf: %v", err)}
 	}
 
-	encoded := snappy.Encode(nil, data)
+	return c.write(ctx, data, WriteProtoMsgV1, stats, opts)
+}
+
+func (c *client) WriteProtoV2(
+	ctx context.Context,
+	req *writev2.Request,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	if err := validateSymbolRefs(req); err != nil {
+		return WriteResult{}, writeError{err: err}
+	}
+
+	processed := c.labelProcessor.processWriteV2Request(req)
+	// Like WriteTimeSeries, nothing is sent once relabeling dropped every series.
+	if len(processed.Timeseries) == 0 && len(req.Timeseries) > 0 {
+		return WriteResult{}, nil
+	}
+
+	return c.writeProtoV2(ctx, processed, opts)
+}
+
+// writeProtoV2 writes the request, whose series already carry the external labels.
+func (c *client) writeProtoV2(
+	ctx context.Context,
+	req *writev2.Request,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	if c.downgraded.Load() {
+		return c.writeProto(ctx, v2ToPromWriteRequest(req), opts)
+	}
+
+	stats := writeV2RequestStats(req)
+	spanCtx, span := c.startWriteSpan(ctx, WriteProtoMsgV2, stats)
+
+	data, err := req.Marshal()
+	if err != nil {
+		writeErr := writeError{err: fmt.Errorf("unable to marshal protobuf: %v", err)}
+		endWriteSpan(span, WriteResult{}, writeErr)
+		return WriteResult{}, writeErr
+	}
+
+	result, writeErr := c.write(spanCtx, data, WriteProtoMsgV2, stats, opts)
+	endWriteSpan(span, result, writeErr)
+	if writeErr != nil && writeErr.StatusCode() == http.StatusUnsupportedMediaType {
+		if !c.downgraded.Swap(true) {
+			c.logger.Info("Endpoint does not support Remote Write 2.0, downgrading to Remote Write 1.0")
+		}
+		return c.writeProto(ctx, v2ToPromWriteRequest(req), opts)
+	}
+
+	return result, writeErr
+}
+
+// write compresses the marshaled protobuf message and sends it to the remote write
+// endpoint, retrying recoverable errors according to the retry config. The stats
+// of the message are recorded in the client metrics.
+func (c *client) write(
+	ctx context.Context,
+	data []byte,
+	msg WriteProtoMsg,
+	stats writeStats,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	compression := c.compression
+	if opts.Compression != "" {
+		compression = opts.Compression
+	}
+
+	encoded, contentEncoding, err := compression.encode(data)
+	if err != nil {
+		return WriteResult{}, writeError{err: err}
+	}
+
+	stats.uncompressed, stats.compressed = len(data), len(encoded)
+	c.metrics.encoded(stats)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(payloadBytesAttribute.Int(len(encoded)))
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		result, writeErr := c.send(ctx, encoded, contentEncoding, msg, opts)
+		c.metrics.requestDone(time.Since(start))
+		span.SetAttributes(retriesAttribute.Int(attempt - 1))
+		if writeErr == nil {
+			c.metrics.sent(stats)
+			return result, nil
+		}
+
+		we, ok := writeErr.(writeError)
+		if attempt >= c.retry.MaxAttempts || !ok || !we.recoverable {
+			// Remote Write 2.0 requests rejected with 415 are resent as Remote Write 1.0.
+			if msg != WriteProtoMsgV2 || writeErr.StatusCode() != http.StatusUnsupportedMediaType {
+				c.metrics.failed(stats)
+				c.logger.Error("Remote write failed",
+					writeErrorAttr(writeErr),
+					"attempts", attempt,
+					"series", stats.series,
+					"samples", stats.samples,
+				)
+			}
+			return result, writeErr
+		}
+
+		backoff := c.retry.backoff(attempt, we.retryAfter)
+		c.logger.Warn("Retrying remote write", writeErrorAttr(writeErr), "attempt", attempt, "backoff", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.metrics.failed(stats)
+			c.logger.Error("Remote write failed",
+				writeErrorAttr(writeErr),
+				"attempts", attempt,
+				"series", stats.series,
+				"samples", stats.samples,
+				"ctx_err", ctx.Err(),
+			)
+			return result, writeErr
+		case <-timer.C:
+		}
+		c.metrics.retried(stats)
+	}
+}
+
+// send makes a single attempt at sending the encoded message.
+func (c *client) send(
+	ctx context.Context,
+	encoded []byte,
+	contentEncoding string,
+	msg WriteProtoMsg,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	var result WriteResult
 
 	body := bytes.NewReader(encoded)
 	req, err := http.NewRequest("POST", c.writeURL, body)
@@ -231,10 +846,18 @@ func (c *client) WriteProto(
 		return result, writeError{err: err}
 	}
 
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("Content-Encoding", "snappy")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
 	req.Header.Set("User-Agent", c.userAgent)
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if msg == WriteProtoMsgV2 {
+		req.Header.Set("Content-Type", appProtoContentType+appProtoContentTypeV2Suffix)
+		req.Header.Set(remoteWriteVersionHeader, remoteWriteVersion20Header)
+	} else {
+		req.Header.Set("Content-Type", appProtoContentType)
+		req.Header.Set(remoteWriteVersionHeader, remoteWriteVersion1Header)
+	}
+	c.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 	if opts.Headers != nil {
 		for k, v := range opts.Headers {
 			req.Header.Set(k, v)
@@ -243,7 +866,7 @@ func (c *client) WriteProto(
 
 	resp, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return result, writeError{err: err}
+		return result, writeError{err: err, recoverable: ctx.Err() == nil}
 	}
 
 	result.StatusCode = resp.StatusCode
@@ -252,16 +875,20 @@ func (c *client) WriteProto(
 
 	if result.StatusCode/100 != 2 {
 		writeErr := writeError{
-			err:  fmt.Errorf("expected HTTP 200 status code: actual=%d", resp.StatusCode),
-			code: result.StatusCode,
+			err:         fmt.Errorf("expected HTTP 200 status code: actual=%d", resp.StatusCode),
+			code:        result.StatusCode,
+			recoverable: c.retry.retryableStatus(result.StatusCode),
+			retryAfter:  parseRetryAfter(resp.Header.Get("Retry-After")),
 		}
 
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
+			c.logger.Warn("Remote write request rejected", "status", result.StatusCode, "body_read_error", err)
 			writeErr.err = fmt.Errorf("%v, body_read_error=%s", writeErr.err, err)
 			return result, writeErr
 		}
 
+		c.logger.Warn("Remote write request rejected", "status", result.StatusCode, "body", truncateBody(body))
 		writeErr.err = fmt.Errorf("%v, body=%s", writeErr.err, body)
 		return result, writeErr
 	}
@@ -270,7 +897,7 @@ func (c *client) WriteProto(
 }
 
 // toPromWriteRequest converts a list of timeseries to a Prometheus proto write request.
-func (t TSList) toPromWriteRequest() *prompb.WriteRequest {
+func (t TSList) toPromWriteRequest() (*prompb.WriteRequest, error) {
 	promTS := make([]prompb.TimeSeries, len(t))
 
 	for i, ts := range t {
@@ -279,28 +906,148 @@ func (t TSList) toPromWriteRequest() *prompb.WriteRequest {
 			labels[j] = prompb.Label{Name: label.Name, Value: label.Value}
 		}
 
-		sample := []prompb.Sample{prompb.Sample{
-			// Timestamp is int milliseconds for remote write.
-			Timestamp: ts.Datapoint.Timestamp.UnixNano() / int64(time.Millisecond),
-			Value:     ts.Datapoint.Value,
-		}}
-		promTS[i] = prompb.TimeSeries{Labels: labels, Samples: sample}
+		datapoints := ts.datapoints()
+		samples := make([]prompb.Sample, len(datapoints))
+		for j, dp := range datapoints {
+			samples[j] = prompb.Sample{
+				Timestamp: toMillis(dp.Timestamp),
+				Value:     dp.Value,
+			}
+		}
+
+		hDatapoints, err := ts.histograms()
+		if err != nil {
+			return nil, err
+		}
+		var histograms []prompb.Histogram
+		for _, hdp := range hDatapoints {
+			if hdp.Histogram != nil {
+				histograms = append(histograms, prompb.FromIntHistogram(toMillis(hdp.Timestamp), hdp.Histogram))
+			} else {
+				histograms = append(histograms, prompb.FromFloatHistogram(toMillis(hdp.Timestamp), hdp.FloatHistogram))
+			}
+		}
+
+		var exemplars []prompb.Exemplar
+		for _, e := range seriesExemplars(datapoints, hDatapoints) {
+			exemplarLabels := make([]prompb.Label, len(e.Labels))
+			for j, label := range e.Labels {
+				exemplarLabels[j] = prompb.Label{Name: label.Name, Value: label.Value}
+			}
+			exemplars = append(exemplars, prompb.Exemplar{
+				Labels:    exemplarLabels,
+				Value:     e.Value,
+				Timestamp: toMillis(e.Timestamp),
+			})
+		}
+
+		promTS[i] = prompb.TimeSeries{
+			Labels:     labels,
+			Samples:    samples,
+			Histograms: histograms,
+			Exemplars:  exemplars,
+		}
 	}
 
 	return &prompb.WriteRequest{
 		Timeseries: promTS,
+		Metadata:   t.seriesMetadata(),
+	}, nil
+}
+
+// datapoints returns the datapoints of the series sorted by timestamp.
+func (ts TimeSeries) datapoints() []Datapoint {
+	if len(ts.Datapoints) == 0 {
+		if len(ts.Histograms) > 0 && ts.Datapoint.Timestamp.IsZero() {
+			return nil
+		}
+		return []Datapoint{ts.Datapoint}
+	}
+
+	datapoints := make([]Datapoint, len(ts.Datapoints))
+	copy(datapoints, ts.Datapoints)
+	sort.SliceStable(datapoints, func(i, j int) bool {
+		return datapoints[i].Timestamp.Before(datapoints[j].Timestamp)
+	})
+
+	return datapoints
+}
+
+// sampleCount returns the number of samples and histograms of the series.
+func (ts TimeSeries) sampleCount() int {
+	if len(ts.Datapoints) > 0 {
+		return len(ts.Datapoints) + len(ts.Histograms)
+	}
+	if len(ts.Histograms) > 0 && ts.Datapoint.Timestamp.IsZero() {
+		return len(ts.Histograms)
+	}
+
+	return 1 + len(ts.Histograms)
+}
+
+// histograms returns the histogram datapoints of the series sorted by timestamp.
+func (ts TimeSeries) histograms() ([]HistogramDatapoint, error) {
+	histograms := make([]HistogramDatapoint, len(ts.Histograms))
+	for i, h := range ts.Histograms {
+		if (h.Histogram == nil) == (h.FloatHistogram == nil) {
+			return nil, fmt.Errorf("histogram datapoint %d of series %v must set exactly one of Histogram or FloatHistogram", i, ts.Labels)
+		}
+		histograms[i] = h
 	}
+
+	sort.SliceStable(histograms, func(i, j int) bool {
+		return histograms[i].Timestamp.Before(histograms[j].Timestamp)
+	})
+
+	return histograms, nil
+}
+
+// seriesExemplars returns the exemplars of the given datapoints sorted by timestamp,
+// defaulting their timestamps to the ones of the datapoints they are attached to.
+func seriesExemplars(datapoints []Datapoint, histograms []HistogramDatapoint) []Exemplar {
+	var exemplars []Exemplar
+	add := func(es []Exemplar, t time.Time) {
+		for _, e := range es {
+			if e.Timestamp.IsZero() {
+				e.Timestamp = t
+			}
+			exemplars = append(exemplars, e)
+		}
+	}
+
+	for _, dp := range datapoints {
+		add(dp.Exemplars, dp.Timestamp)
+	}
+	for _, h := range histograms {
+		add(h.Exemplars, h.Timestamp)
+	}
+
+	sort.SliceStable(exemplars, func(i, j int) bool {
+		return exemplars[i].Timestamp.Before(exemplars[j].Timestamp)
+	})
+
+	return exemplars
 }
 
 type writeError struct {
 	err  error
 	code int
+
+	// recoverable is set when the write may succeed if retried.
+	recoverable bool
+	// retryAfter is the delay requested by the Retry-After response header.
+	retryAfter time.Duration
 }
 
 func (e writeError) Error() string {
 	return e.err.Error()
 }
 
+// Unwrap returns the underlying error.
+func (e writeError) Unwrap() error {
+	return e.err
+}
+
 // StatusCode returns the HTTP status code of the error if error
 // was caused by the response, otherwise it will be just zero.
 func (e writeError) StatusCode() int {
@@ -21,7 +21,10 @@
 package promremote
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -30,7 +33,10 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,6 +46,53 @@ var (
 	nowMillis = now.UnixNano() / int64(time.Millisecond)
 )
 
+// decodeRequestBody reads the body of a write request and decompresses it
+// according to its Content-Encoding.
+func decodeRequestBody(t *testing.T, r *http.Request) []byte {
+	defer r.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+
+	var decoded []byte
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "snappy":
+		decoded, err = snappy.Decode(nil, bodyBytes)
+	case "zstd":
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer decoder.Close()
+		decoded, err = decoder.DecodeAll(bodyBytes, nil)
+	case "gzip":
+		var reader *gzip.Reader
+		reader, err = gzip.NewReader(bytes.NewReader(bodyBytes))
+		require.NoError(t, err)
+		decoded, err = io.ReadAll(reader)
+	case "":
+		decoded = bodyBytes
+	default:
+		t.Fatalf("unexpected Content-Encoding: %s", encoding)
+	}
+	require.NoError(t, err)
+
+	return decoded
+}
+
+func decodeWriteRequest(t *testing.T, r *http.Request) *prompb.WriteRequest {
+	wr := &prompb.WriteRequest{}
+	require.NoError(t, proto.Unmarshal(decodeRequestBody(t, r), wr))
+
+	return wr
+}
+
+func decodeWriteRequestV2(t *testing.T, r *http.Request) *writev2.Request {
+	req := &writev2.Request{}
+	require.NoError(t, req.Unmarshal(decodeRequestBody(t, r)))
+
+	return req
+}
+
 func TestPromRemoteClientWrite(t *testing.T) {
 	overrideUserAgent := "overrideUserAgent"
 	customHeaders := map[string]string{
@@ -178,3 +231,175 @@ func TestProvidedHTTPClient(t *testing.T) {
 	_, err := NewClient(cfg)
 	require.NoError(t, err)
 }
+
+func TestToPromWriteRequestMultipleDatapoints(t *testing.T) {
+	tsList := TSList{
+		{
+			Labels: []Label{{Name: "__name__", Value: "foo_bar"}},
+			Datapoints: []Datapoint{
+				{Timestamp: now.Add(2 * time.Minute), Value: 3},
+				{Timestamp: now, Value: 1},
+				{Timestamp: now.Add(time.Minute), Value: 2},
+			},
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "foo_baz"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 42},
+		},
+	}
+
+	wr, err := tsList.toPromWriteRequest()
+	require.NoError(t, err)
+
+	require.Len(t, wr.Timeseries, 2)
+	assert.Equal(t, []prompb.Sample{
+		{Timestamp: nowMillis, Value: 1},
+		{Timestamp: nowMillis + 60000, Value: 2},
+		{Timestamp: nowMillis + 120000, Value: 3},
+	}, wr.Timeseries[0].Samples)
+	assert.Equal(t, []prompb.Sample{{Timestamp: nowMillis, Value: 42}}, wr.Timeseries[1].Samples)
+
+	// The caller's datapoints are left in their original order.
+	assert.Equal(t, float64(3), tsList[0].Datapoints[0].Value)
+
+	v2, err := tsList.toWriteV2Request()
+	require.NoError(t, err)
+	require.Len(t, v2.Timeseries, 2)
+	require.Len(t, v2.Timeseries[0].Samples, 3)
+	assert.Equal(t, nowMillis, v2.Timeseries[0].Samples[0].Timestamp)
+	assert.Equal(t, nowMillis+120000, v2.Timeseries[0].Samples[2].Timestamp)
+}
+
+func TestPromRemoteClientWriteHistograms(t *testing.T) {
+	intHistogram := &histogram.Histogram{
+		CounterResetHint: histogram.CounterReset,
+		Schema:           1,
+		ZeroThreshold:    0.01,
+		ZeroCount:        2,
+		Count:            12,
+		Sum:              18.4,
+		PositiveSpans:    []histogram.Span{{Offset: 0, Length: 2}, {Offset: 1, Length: 2}},
+		PositiveBuckets:  []int64{1, 1, -1, 0},
+		NegativeSpans:    []histogram.Span{{Offset: 0, Length: 2}},
+		NegativeBuckets:  []int64{2, 1},
+	}
+	floatHistogram := &histogram.FloatHistogram{
+		CounterResetHint: histogram.GaugeType,
+		Schema:           0,
+		ZeroThreshold:    0.001,
+		ZeroCount:        1.5,
+		Count:            7.5,
+		Sum:              21.25,
+		PositiveSpans:    []histogram.Span{{Offset: 1, Length: 2}},
+		PositiveBuckets:  []float64{2.5, 3.5},
+		NegativeSpans:    []histogram.Span{},
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wr := decodeWriteRequest(t, r)
+
+		require.Len(t, wr.Timeseries, 1)
+		ts := wr.Timeseries[0]
+		assert.Empty(t, ts.Samples)
+		require.Len(t, ts.Histograms, 2)
+
+		assert.False(t, ts.Histograms[0].IsFloatHistogram())
+		assert.Equal(t, nowMillis, ts.Histograms[0].Timestamp)
+		assert.Equal(t, prompb.Histogram_YES, ts.Histograms[0].ResetHint)
+		assert.Equal(t, intHistogram, ts.Histograms[0].ToIntHistogram())
+
+		assert.True(t, ts.Histograms[1].IsFloatHistogram())
+		assert.Equal(t, nowMillis+1000, ts.Histograms[1].Timestamp)
+		assert.Equal(t, prompb.Histogram_GAUGE, ts.Histograms[1].ResetHint)
+		assert.Equal(t, floatHistogram, ts.Histograms[1].ToFloatHistogram())
+	}))
+
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(WriteURLOption(testServer.URL)))
+	require.NoError(t, err)
+
+	tsList := TSList{{
+		Labels: []Label{{Name: "__name__", Value: "rpc_duration_seconds"}},
+		Histograms: []HistogramDatapoint{
+			{Timestamp: now.Add(time.Second), FloatHistogram: floatHistogram},
+			{Timestamp: now, Histogram: intHistogram},
+		},
+	}}
+
+	r, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+
+	v2, err := tsList.toWriteV2Request()
+	require.NoError(t, err)
+	require.Len(t, v2.Timeseries[0].Histograms, 2)
+	assert.Empty(t, v2.Timeseries[0].Samples)
+	assert.Equal(t, intHistogram, v2.Timeseries[0].Histograms[0].ToIntHistogram())
+	assert.Equal(t, floatHistogram, v2.Timeseries[0].Histograms[1].ToFloatHistogram())
+}
+
+func TestPromRemoteClientWriteInvalidHistogram(t *testing.T) {
+	c, err := NewClient(NewConfig())
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), TSList{{
+		Labels:     []Label{{Name: "__name__", Value: "rpc_duration_seconds"}},
+		Histograms: []HistogramDatapoint{{Timestamp: now}},
+	}}, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, 0, writeErr.StatusCode())
+}
+
+func TestToPromWriteRequestExemplars(t *testing.T) {
+	tsList := TSList{{
+		Labels: []Label{{Name: "__name__", Value: "http_request_duration_seconds"}},
+		Datapoints: []Datapoint{
+			{
+				Timestamp: now.Add(time.Minute),
+				Value:     0.7,
+				Exemplars: []Exemplar{{
+					Labels: []Label{{Name: "trace_id", Value: "def"}},
+					Value:  0.7,
+				}},
+			},
+			{
+				Timestamp: now,
+				Value:     0.2,
+				Exemplars: []Exemplar{{
+					Labels:    []Label{{Name: "trace_id", Value: "abc"}},
+					Value:     0.25,
+					Timestamp: now.Add(-time.Second),
+				}},
+			},
+		},
+	}}
+
+	wr, err := tsList.toPromWriteRequest()
+	require.NoError(t, err)
+
+	require.Len(t, wr.Timeseries, 1)
+	assert.Equal(t, []prompb.Exemplar{
+		{
+			Labels:    []prompb.Label{{Name: "trace_id", Value: "abc"}},
+			Value:     0.25,
+			Timestamp: nowMillis - 1000,
+		},
+		{
+			Labels:    []prompb.Label{{Name: "trace_id", Value: "def"}},
+			Value:     0.7,
+			Timestamp: nowMillis + 60000,
+		},
+	}, wr.Timeseries[0].Exemplars)
+
+	v2, err := tsList.toWriteV2Request()
+	require.NoError(t, err)
+
+	exemplars := v2.Timeseries[0].Exemplars
+	require.Len(t, exemplars, 2)
+	assert.Equal(t, "trace_id", v2.Symbols[exemplars[0].LabelsRefs[0]])
+	assert.Equal(t, "abc", v2.Symbols[exemplars[0].LabelsRefs[1]])
+	assert.Equal(t, nowMillis-1000, exemplars[0].Timestamp)
+	assert.Equal(t, "def", v2.Symbols[exemplars[1].LabelsRefs[1]])
+	assert.Equal(t, 0.7, exemplars[1].Value)
+}
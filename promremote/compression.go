@@ -0,0 +1,89 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm the payload of write requests is compressed with.
+type Compression string
+
+const (
+	// CompressionSnappy is the block snappy compression required by the remote write spec.
+	CompressionSnappy Compression = "snappy"
+	// CompressionZstd is zstd compression, accepted by receivers such as VictoriaMetrics.
+	CompressionZstd Compression = "zstd"
+	// CompressionGzip is gzip compression.
+	CompressionGzip Compression = "gzip"
+	// CompressionNone sends payloads uncompressed.
+	CompressionNone Compression = "none"
+)
+
+// zstdEncoder is shared by all clients since EncodeAll is safe for concurrent use.
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+func (c Compression) validate() error {
+	switch c {
+	case "", CompressionSnappy, CompressionZstd, CompressionGzip, CompressionNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression: %s", c)
+	}
+}
+
+// encode compresses the data and returns it with the matching `Content-Encoding`
+// header value, which is blank for uncompressed payloads. A blank compression
+// defaults to snappy.
+func (c Compression) encode(data []byte) ([]byte, string, error) {
+	switch c {
+	case "", CompressionSnappy:
+		return snappy.Encode(nil, data), string(CompressionSnappy), nil
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to create zstd encoder: %v", err)
+		}
+		return encoder.EncodeAll(data, nil), string(CompressionZstd), nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", fmt.Errorf("unable to gzip payload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", fmt.Errorf("unable to gzip payload: %v", err)
+		}
+		return buf.Bytes(), string(CompressionGzip), nil
+	case CompressionNone:
+		return data, "", nil
+	default:
+		return nil, "", fmt.Errorf("unknown compression: %s", c)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCompression(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           Compression
+		override         Compression
+		expectedEncoding string
+	}{
+		{name: "default", expectedEncoding: "snappy"},
+		{name: "zstd", config: CompressionZstd, expectedEncoding: "zstd"},
+		{name: "gzip", config: CompressionGzip, expectedEncoding: "gzip"},
+		{name: "none", config: CompressionNone, expectedEncoding: ""},
+		{name: "write options override", config: CompressionZstd, override: CompressionGzip, expectedEncoding: "gzip"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				encoding string
+				req      *prompb.WriteRequest
+			)
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Content-Encoding")
+				req = decodeWriteRequest(t, r)
+			}))
+			defer testServer.Close()
+
+			opts := []ConfigOption{WriteURLOption(testServer.URL)}
+			if test.config != "" {
+				opts = append(opts, CompressionOption(test.config))
+			}
+			c, err := NewClient(NewConfig(opts...))
+			require.NoError(t, err)
+
+			_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList,
+				WriteOptions{Compression: test.override})
+			require.NoError(t, writeErr)
+
+			assert.Equal(t, test.expectedEncoding, encoding)
+			require.Len(t, req.Timeseries, 1)
+			assert.Equal(t, 1415.92, req.Timeseries[0].Samples[0].Value)
+		})
+	}
+}
+
+func TestClientUnknownCompression(t *testing.T) {
+	_, err := NewClient(NewConfig(CompressionOption("lz4")))
+	require.Error(t, err)
+
+	c, err := NewClient(NewConfig())
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{Compression: "lz4"})
+	require.Error(t, writeErr)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+func validateExternalLabels(externalLabels map[string]string) error {
+	for name, value := range externalLabels {
+		if !model.LabelName(name).IsValidLegacy() {
+			return fmt.Errorf("invalid external label name: %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("external label %q should not have a blank value", name)
+		}
+	}
+
+	return nil
+}
+
+// sortedLabels returns the labels of the map sorted by name.
+func sortedLabels(labelMap map[string]string) []Label {
+	labels := make([]Label, 0, len(labelMap))
+	for name, value := range labelMap {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return labels
+}
+
+// missingExternalLabels returns the external labels whose name is not taken by
+// the labels of a series, which always take precedence. As in Prometheus, a
+// label with an empty value does not exist and takes no precedence.
+func missingExternalLabels(external, labels []Label) []Label {
+	var missing []Label
+	for _, e := range external {
+		taken := false
+		for _, l := range labels {
+			if l.Name == e.Name && l.Value != "" {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			missing = append(missing, e)
+		}
+	}
+
+	return missing
+}
+
+// withExternalLabels returns the labels with the missing external labels added,
+// replacing empty-valued labels of the same name and sorting them if any was.
+func withExternalLabels(labels, external []Label) []Label {
+	missing := missingExternalLabels(external, labels)
+	if len(missing) == 0 {
+		return labels
+	}
+
+	withLabels := make([]Label, 0, len(labels)+len(missing))
+	for _, l := range labels {
+		if l.Value == "" && hasLabel(missing, l.Name) {
+			continue
+		}
+		withLabels = append(withLabels, l)
+	}
+	withLabels = append(withLabels, missing...)
+	sort.SliceStable(withLabels, func(i, j int) bool {
+		return withLabels[i].Name < withLabels[j].Name
+	})
+
+	return withLabels
+}
+
+func hasLabel(labels []Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
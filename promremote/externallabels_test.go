@@ -0,0 +1,174 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testExternalLabels = map[string]string{
+	"cluster": "eu-1",
+	"env":     "prod",
+}
+
+func TestClientExternalLabels(t *testing.T) {
+	var req *prompb.WriteRequest
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = decodeWriteRequest(t, r)
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		ExternalLabelsOption(testExternalLabels),
+	))
+	require.NoError(t, err)
+
+	tsList := TSList{
+		{
+			Labels:    []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 1},
+		},
+		{
+			// The label of the series takes precedence over the external label.
+			Labels:    []Label{{Name: "__name__", Value: "up"}, {Name: "env", Value: "staging"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 1},
+		},
+		{
+			// An empty-valued label does not hide the external label.
+			Labels:    []Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: ""}},
+			Datapoint: Datapoint{Timestamp: now, Value: 1},
+		},
+	}
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 3)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu-1"},
+		{Name: "env", Value: "prod"},
+		{Name: "job", Value: "api"},
+	}, req.Timeseries[0].Labels)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu-1"},
+		{Name: "env", Value: "staging"},
+	}, req.Timeseries[1].Labels)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu-1"},
+		{Name: "env", Value: "prod"},
+	}, req.Timeseries[2].Labels)
+
+	// The written series are left untouched.
+	assert.Len(t, tsList[0].Labels, 2)
+
+	promWR := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: "us-1"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: nowMillis}},
+	}}}
+
+	_, writeErr = c.WriteProto(context.Background(), promWR, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "us-1"},
+		{Name: "env", Value: "prod"},
+	}, req.Timeseries[0].Labels)
+	assert.Len(t, promWR.Timeseries[0].Labels, 2)
+}
+
+func TestClientExternalLabelsV2(t *testing.T) {
+	var req *writev2.Request
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = decodeWriteRequestV2(t, r)
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+		ExternalLabelsOption(testExternalLabels),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), TSList{{
+		Labels:    []Label{{Name: "__name__", Value: "up"}, {Name: "env", Value: "staging"}},
+		Datapoint: Datapoint{Timestamp: now, Value: 1},
+	}}, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu-1"},
+		{Name: "env", Value: "staging"},
+	}, desymbolizeLabels(req.Timeseries[0].LabelsRefs, req.Symbols))
+
+	symbols := writev2.NewSymbolTable()
+	v2Req := &writev2.Request{
+		Timeseries: []writev2.TimeSeries{{
+			LabelsRefs: symbols.SymbolizeLabels(labels.FromStrings("__name__", "up", "job", "api"), nil),
+			Samples:    []writev2.Sample{{Value: 1, Timestamp: nowMillis}},
+		}},
+		Symbols: symbols.Symbols(),
+	}
+
+	_, writeErr = c.(V2Writer).WriteProtoV2(context.Background(), v2Req, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "cluster", Value: "eu-1"},
+		{Name: "env", Value: "prod"},
+		{Name: "job", Value: "api"},
+	}, desymbolizeLabels(req.Timeseries[0].LabelsRefs, req.Symbols))
+	assert.Len(t, v2Req.Timeseries[0].LabelsRefs, 4)
+}
+
+func TestValidateConfigExternalLabels(t *testing.T) {
+	tests := []map[string]string{
+		{"": "eu-1"},
+		{"foo-bar": "eu-1"},
+		{"1abc": "eu-1"},
+		{"a b": "eu-1"},
+		{"cluster": ""},
+	}
+
+	for _, externalLabels := range tests {
+		_, err := NewClient(NewConfig(ExternalLabelsOption(externalLabels)))
+		require.Error(t, err, "%v", externalLabels)
+	}
+}
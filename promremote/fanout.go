@@ -0,0 +1,397 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// FanoutPolicy decides whether a write fanned out to several endpoints succeeded.
+type FanoutPolicy string
+
+const (
+	// FanoutAll requires the write to succeed on every endpoint.
+	FanoutAll FanoutPolicy = "all"
+	// FanoutAny requires the write to succeed on at least one endpoint.
+	FanoutAny FanoutPolicy = "any"
+	// FanoutQuorum requires the write to succeed on FanoutConfig.Quorum endpoints.
+	FanoutQuorum FanoutPolicy = "quorum"
+)
+
+// FanoutConfig defines the configuration used to construct a fan-out client.
+type FanoutConfig struct {
+	// Endpoints are the endpoints every write is sent to.
+	Endpoints []EndpointConfig `yaml:"endpoints"`
+
+	// Policy decides whether a write succeeded. If blank, it must succeed on all endpoints.
+	Policy FanoutPolicy `yaml:"policy"`
+
+	// Quorum is the number of endpoints a write must succeed on with the
+	// quorum policy. If 0, a majority of the endpoints is required.
+	Quorum int `yaml:"quorum"`
+
+	// Logger, if not nil, logs the endpoints a write failed on when the write
+	// still succeeded under the policy.
+	Logger *slog.Logger `yaml:"-"`
+}
+
+// EndpointConfig defines an endpoint of a fan-out or sharding client.
+type EndpointConfig struct {
+	// Name identifies the endpoint in errors and logs, and on the hash ring of
+	// a sharding client. If blank, the write URL without credentials is used.
+	// Sharded series keep their endpoint across restarts as long as the names
+	// do not change.
+	Name string `yaml:"name"`
+
+	// Config is used to construct the client of the endpoint, with its own
+	// URL, auth and relabeling.
+	Config Config `yaml:"config"`
+
+	// Client, if not nil, is used instead of constructing one from Config.
+	Client Client `yaml:"-"`
+
+	// Headers are set on every request to the endpoint. Headers of the write
+	// options override them.
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (p FanoutPolicy) validate() error {
+	switch p {
+	case "", FanoutAll, FanoutAny, FanoutQuorum:
+		return nil
+	default:
+		return fmt.Errorf("unknown fan-out policy: %s", p)
+	}
+}
+
+func (c FanoutConfig) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("fan-out client should have at least one endpoint")
+	}
+
+	if err := c.Policy.validate(); err != nil {
+		return err
+	}
+
+	if c.Quorum < 0 || c.Quorum > len(c.Endpoints) {
+		return fmt.Errorf("fan-out quorum should be between 0 and the number of endpoints: %d", c.Quorum)
+	}
+
+	return nil
+}
+
+// required returns the number of endpoints a write must succeed on.
+func (c FanoutConfig) required() int {
+	switch c.Policy {
+	case FanoutAny:
+		return 1
+	case FanoutQuorum:
+		if c.Quorum > 0 {
+			return c.Quorum
+		}
+		return len(c.Endpoints)/2 + 1
+	default:
+		return len(c.Endpoints)
+	}
+}
+
+// EndpointError is the error a write failed with on an endpoint of a fan-out
+// or sharding client.
+type EndpointError struct {
+	Endpoint string
+	Err      WriteError
+}
+
+// endpointErrors are the errors of the failed endpoints of a write, shared by
+// FanoutError and ShardingError.
+type endpointErrors []EndpointError
+
+func (errs endpointErrors) message(write string) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = fmt.Sprintf("%s: %v", err.Endpoint, err.Err)
+	}
+
+	return fmt.Sprintf("%s failed on %d endpoints: %s", write, len(errs), strings.Join(msgs, "; "))
+}
+
+// statusCode returns the status code of the first endpoint error caused by a
+// response, otherwise it will be just zero.
+func (errs endpointErrors) statusCode() int {
+	for _, err := range errs {
+		if code := err.Err.StatusCode(); code != 0 {
+			return code
+		}
+	}
+
+	return 0
+}
+
+func (errs endpointErrors) unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err.Err
+	}
+
+	return unwrapped
+}
+
+// FanoutError is returned when a write fanned out to several endpoints
+// succeeded on too few of them for the policy.
+type FanoutError struct {
+	Policy FanoutPolicy
+	// Errors are the errors of the failed endpoints, in the order of the config.
+	Errors []EndpointError
+}
+
+func (e *FanoutError) Error() string {
+	return endpointErrors(e.Errors).message("fan-out write")
+}
+
+// StatusCode returns the status code of the first endpoint error caused by a
+// response, otherwise it will be just zero.
+func (e *FanoutError) StatusCode() int {
+	return endpointErrors(e.Errors).statusCode()
+}
+
+// Unwrap returns the errors of the failed endpoints.
+func (e *FanoutError) Unwrap() []error {
+	return endpointErrors(e.Errors).unwrap()
+}
+
+func (e *FanoutError) endpointErrors() []EndpointError {
+	return e.Errors
+}
+
+// endpoint is a client writing to one of the endpoints of a fan-out or sharding client.
+type endpoint struct {
+	name    string
+	client  Client
+	headers map[string]string
+}
+
+// writeProtoV2 writes the Remote Write 2.0 request through the client of an
+// endpoint, failing if the client does not implement V2Writer.
+func writeProtoV2(ctx context.Context, c Client, req *writev2.Request, opts WriteOptions) (WriteResult, WriteError) {
+	w, ok := c.(V2Writer)
+	if !ok {
+		return WriteResult{}, writeError{err: fmt.Errorf("client %T does not implement V2Writer", c)}
+	}
+
+	return w.WriteProtoV2(ctx, req, opts)
+}
+
+// writeMetadata writes the metadata through the client of an endpoint,
+// failing if the client does not implement MetadataWriter.
+func writeMetadata(ctx context.Context, c Client, md MetadataList, opts WriteOptions) (WriteResult, WriteError) {
+	w, ok := c.(MetadataWriter)
+	if !ok {
+		return WriteResult{}, writeError{err: fmt.Errorf("client %T does not implement MetadataWriter", c)}
+	}
+
+	return w.WriteMetadata(ctx, md, opts)
+}
+
+// newEndpoint returns the endpoint of the config, named after the write URL
+// without credentials if blank, constructing its client from the config
+// unless one is given.
+func newEndpoint(cfg EndpointConfig) (endpoint, error) {
+	name := cfg.Name
+	if name == "" {
+		name = redactURL(cfg.Config.WriteURL)
+	}
+
+	c := cfg.Client
+	if c == nil {
+		var err error
+		if c, err = NewClient(cfg.Config); err != nil {
+			return endpoint{}, fmt.Errorf("invalid endpoint %s: %v", name, err)
+		}
+	}
+
+	return endpoint{name: name, client: c, headers: cfg.Headers}, nil
+}
+
+var (
+	_ V2Writer       = (*fanoutClient)(nil)
+	_ MetadataWriter = (*fanoutClient)(nil)
+)
+
+type fanoutClient struct {
+	endpoints []endpoint
+	policy    FanoutPolicy
+	required  int
+	logger    *slog.Logger
+}
+
+// NewFanoutClient creates a client writing concurrently to all endpoints of
+// the config, which succeeds according to the fan-out policy.
+func NewFanoutClient(cfg FanoutConfig) (Client, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	policy := cfg.Policy
+	if policy == "" {
+		policy = FanoutAll
+	}
+
+	endpoints := make([]endpoint, len(cfg.Endpoints))
+	names := make(map[string]struct{}, len(cfg.Endpoints))
+	for i, e := range cfg.Endpoints {
+		endpoint, err := newEndpoint(e)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := names[endpoint.name]; ok {
+			return nil, fmt.Errorf("duplicate fan-out endpoint name: %s", endpoint.name)
+		}
+		names[endpoint.name] = struct{}{}
+
+		endpoints[i] = endpoint
+	}
+
+	return &fanoutClient{
+		endpoints: endpoints,
+		policy:    policy,
+		required:  cfg.required(),
+		logger:    loggerOrDiscard(cfg.Logger),
+	}, nil
+}
+
+func (c *fanoutClient) WriteProto(
+	ctx context.Context,
+	req *prompb.WriteRequest,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	return c.fanout(ctx, opts, func(client Client, opts WriteOptions) (WriteResult, WriteError) {
+		return client.WriteProto(ctx, req, opts)
+	})
+}
+
+func (c *fanoutClient) WriteProtoV2(
+	ctx context.Context,
+	req *writev2.Request,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	return c.fanout(ctx, opts, func(client Client, opts WriteOptions) (WriteResult, WriteError) {
+		return writeProtoV2(ctx, client, req, opts)
+	})
+}
+
+func (c *fanoutClient) WriteTimeSeries(
+	ctx context.Context,
+	ts TSList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	return c.fanout(ctx, opts, func(client Client, opts WriteOptions) (WriteResult, WriteError) {
+		return client.WriteTimeSeries(ctx, ts, opts)
+	})
+}
+
+func (c *fanoutClient) WriteMetadata(
+	ctx context.Context,
+	md MetadataList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	return c.fanout(ctx, opts, func(client Client, opts WriteOptions) (WriteResult, WriteError) {
+		return writeMetadata(ctx, client, md, opts)
+	})
+}
+
+// fanout runs the write concurrently on every endpoint and waits for all of
+// them. The result is the one of the first successful endpoint in the order
+// of the config.
+func (c *fanoutClient) fanout(
+	ctx context.Context,
+	opts WriteOptions,
+	write func(Client, WriteOptions) (WriteResult, WriteError),
+) (WriteResult, WriteError) {
+	var (
+		results = make([]WriteResult, len(c.endpoints))
+		errs    = make([]WriteError, len(c.endpoints))
+		wg      sync.WaitGroup
+	)
+	for i, e := range c.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = write(e.client, e.writeOptions(opts))
+		}()
+	}
+	wg.Wait()
+
+	var (
+		result    WriteResult
+		succeeded int
+		failed    []EndpointError
+	)
+	for i, e := range c.endpoints {
+		if errs[i] != nil {
+			failed = append(failed, EndpointError{Endpoint: e.name, Err: errs[i]})
+			continue
+		}
+		if succeeded == 0 {
+			result = results[i]
+		}
+		succeeded++
+	}
+
+	if succeeded < c.required {
+		return result, &FanoutError{Policy: c.policy, Errors: failed}
+	}
+
+	for _, f := range failed {
+		c.logger.Warn("Fan-out write failed on endpoint",
+			"endpoint", f.Endpoint,
+			"policy", c.policy,
+			writeErrorAttr(f.Err),
+		)
+	}
+
+	return result, nil
+}
+
+// writeOptions returns the write options with the headers of the endpoint added.
+func (e endpoint) writeOptions(opts WriteOptions) WriteOptions {
+	if len(e.headers) == 0 {
+		return opts
+	}
+
+	headers := make(map[string]string, len(e.headers)+len(opts.Headers))
+	for k, v := range e.headers {
+		headers[k] = v
+	}
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	opts.Headers = headers
+
+	return opts
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanoutClientEndpoints(t *testing.T) {
+	type received struct {
+		labels []prompb.Label
+		tenant string
+		trace  string
+	}
+
+	var (
+		mtx      sync.Mutex
+		requests = map[string]received{}
+	)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := decodeWriteRequest(t, r)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			requests[name] = received{
+				labels: req.Timeseries[0].Labels,
+				tenant: r.Header.Get("X-Scope-OrgID"),
+				trace:  r.Header.Get("X-Trace"),
+			}
+		}))
+	}
+
+	m3 := newServer("m3")
+	defer m3.Close()
+	mimir := newServer("mimir")
+	defer mimir.Close()
+
+	dropJob := relabel.DefaultRelabelConfig
+	dropJob.Regex = relabel.MustNewRegexp("job")
+	dropJob.Action = relabel.LabelDrop
+
+	c, err := NewFanoutClient(FanoutConfig{
+		Endpoints: []EndpointConfig{
+			{
+				Name:   "m3",
+				Config: NewConfig(WriteURLOption(m3.URL)),
+			},
+			{
+				Name: "mimir",
+				Config: NewConfig(
+					WriteURLOption(mimir.URL),
+					ExternalLabelsOption(map[string]string{"cluster": "eu-1"}),
+					WriteRelabelConfigsOption(&dropJob),
+				),
+				Headers: map[string]string{"X-Scope-OrgID": "team-a"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	series := TSList{{
+		Labels:    []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+		Datapoint: Datapoint{Timestamp: now, Value: 1},
+	}}
+	r, writeErr := c.WriteTimeSeries(context.Background(), series, WriteOptions{
+		Headers: map[string]string{"X-Trace": "abc"},
+	})
+	require.NoError(t, writeErr)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	assert.Equal(t, received{
+		labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "api"}},
+		trace:  "abc",
+	}, requests["m3"])
+	assert.Equal(t, received{
+		labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: "eu-1"}},
+		tenant: "team-a",
+		trace:  "abc",
+	}, requests["mimir"])
+}
+
+func TestFanoutClientPolicies(t *testing.T) {
+	tests := []struct {
+		policy    FanoutPolicy
+		quorum    int
+		failures  int
+		shouldErr bool
+	}{
+		{policy: "", failures: 0},
+		{policy: FanoutAll, failures: 1, shouldErr: true},
+		{policy: FanoutAny, failures: 2},
+		{policy: FanoutAny, failures: 3, shouldErr: true},
+		{policy: FanoutQuorum, failures: 1},
+		{policy: FanoutQuorum, failures: 2, shouldErr: true},
+		{policy: FanoutQuorum, quorum: 1, failures: 2},
+		{policy: FanoutQuorum, quorum: 3, failures: 1, shouldErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s quorum=%d failures=%d", test.policy, test.quorum, test.failures), func(t *testing.T) {
+			var endpoints []EndpointConfig
+			for i := 0; i < 3; i++ {
+				client := &recordingClient{}
+				if i < test.failures {
+					client.writeFn = func(context.Context, TSList) WriteError {
+						return writeError{err: errors.New("unavailable"), code: http.StatusServiceUnavailable, recoverable: true}
+					}
+				}
+				endpoints = append(endpoints, EndpointConfig{Name: fmt.Sprintf("endpoint-%d", i), Client: client})
+			}
+
+			c, err := NewFanoutClient(FanoutConfig{Endpoints: endpoints, Policy: test.policy, Quorum: test.quorum})
+			require.NoError(t, err)
+
+			r, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+			if !test.shouldErr {
+				require.NoError(t, writeErr)
+				assert.Equal(t, http.StatusOK, r.StatusCode)
+				return
+			}
+
+			require.Error(t, writeErr)
+			var fe *FanoutError
+			require.True(t, errors.As(writeErr, &fe))
+			require.Len(t, fe.Errors, test.failures)
+			assert.Equal(t, "endpoint-0", fe.Errors[0].Endpoint)
+			assert.Equal(t, http.StatusServiceUnavailable, writeErr.StatusCode())
+			assert.True(t, recoverable(writeErr))
+		})
+	}
+}
+
+func TestFanoutClientOptionalWriters(t *testing.T) {
+	c, err := NewFanoutClient(FanoutConfig{
+		Endpoints: []EndpointConfig{{Name: "receiver", Client: &recordingClient{}}},
+	})
+	require.NoError(t, err)
+
+	_, writeErr := c.(V2Writer).WriteProtoV2(context.Background(), &writev2.Request{}, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Contains(t, writeErr.Error(), "does not implement V2Writer")
+
+	_, writeErr = c.(MetadataWriter).WriteMetadata(context.Background(), MetadataList{}, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Contains(t, writeErr.Error(), "does not implement MetadataWriter")
+}
+
+func TestNewFanoutClientValidation(t *testing.T) {
+	endpoint := EndpointConfig{Config: NewConfig()}
+
+	tests := []FanoutConfig{
+		{},
+		{Endpoints: []EndpointConfig{endpoint}, Policy: "some"},
+		{Endpoints: []EndpointConfig{endpoint}, Policy: FanoutQuorum, Quorum: 2},
+		{Endpoints: []EndpointConfig{endpoint, endpoint}},
+		{Endpoints: []EndpointConfig{{Config: NewConfig(WriteURLOption(""))}}},
+	}
+
+	for _, cfg := range tests {
+		_, err := NewFanoutClient(cfg)
+		require.Error(t, err)
+	}
+}
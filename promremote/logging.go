@@ -0,0 +1,64 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"log/slog"
+	"unicode/utf8"
+)
+
+// maxLoggedBodyBytes is the length response bodies are truncated to in logs.
+const maxLoggedBodyBytes = 512
+
+// loggerOrDiscard returns the logger, or one discarding all records if it is nil,
+// so that the library stays silent unless a logger is configured.
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.DiscardHandler)
+	}
+
+	return logger
+}
+
+// truncateBody returns the body as a string of at most maxLoggedBodyBytes,
+// without splitting a multi-byte character.
+func truncateBody(body []byte) string {
+	if len(body) <= maxLoggedBodyBytes {
+		return string(body)
+	}
+
+	n := maxLoggedBodyBytes
+	for n > 0 && !utf8.RuneStart(body[n]) {
+		n--
+	}
+
+	return string(body[:n]) + "..."
+}
+
+// writeErrorAttr returns the status code of the error if it was caused by the
+// response, whose body is logged separately, and the error otherwise.
+func writeErrorAttr(err WriteError) slog.Attr {
+	if code := err.StatusCode(); code != 0 {
+		return slog.Int("status", code)
+	}
+
+	return slog.String("err", err.Error())
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler is a slog.Handler that records the messages and attributes it handles.
+type recordingHandler struct {
+	mtx     *sync.Mutex
+	records *[]loggedRecord
+	attrs   []slog.Attr
+}
+
+type loggedRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]slog.Value
+}
+
+func newRecordingLogger() (*slog.Logger, func() []loggedRecord) {
+	h := recordingHandler{mtx: &sync.Mutex{}, records: &[]loggedRecord{}}
+	return slog.New(h), func() []loggedRecord {
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+
+		return append([]loggedRecord(nil), *h.records...)
+	}
+}
+
+func (h recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := loggedRecord{level: r.Level, msg: r.Message, attrs: map[string]slog.Value{}}
+	for _, a := range h.attrs {
+		rec.attrs[a.Key] = a.Value
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.attrs[a.Key] = a.Value
+		return true
+	})
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	*h.records = append(*h.records, rec)
+
+	return nil
+}
+
+func (h recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return h
+}
+
+func (h recordingHandler) WithGroup(string) slog.Handler { return h }
+
+func TestClientLogsRetriesAndFailures(t *testing.T) {
+	body := strings.Repeat("x", 2*maxLoggedBodyBytes)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(body))
+	}))
+	defer testServer.Close()
+
+	logger, records := newRecordingLogger()
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		RetryOption(RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}),
+		LoggerOption(logger),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+
+	var msgs []string
+	for _, r := range records() {
+		msgs = append(msgs, r.msg)
+		assert.Equal(t, testServer.URL, r.attrs["url"].String())
+	}
+	assert.Equal(t, []string{
+		"Created remote write client",
+		"Remote write request rejected",
+		"Retrying remote write",
+		"Remote write request rejected",
+		"Remote write failed",
+	}, msgs)
+
+	rejected := records()[1]
+	assert.Equal(t, slog.LevelWarn, rejected.level)
+	assert.Equal(t, body[:maxLoggedBodyBytes]+"...", rejected.attrs["body"].String())
+
+	failed := records()[4]
+	assert.Equal(t, slog.LevelError, failed.level)
+	assert.Equal(t, int64(http.StatusServiceUnavailable), failed.attrs["status"].Int64())
+	assert.Equal(t, int64(2), failed.attrs["attempts"].Int64())
+	assert.Equal(t, int64(1), failed.attrs["samples"].Int64())
+}
+
+func TestClientLogsInvalidSeriesAndDowngrade(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(remoteWriteVersionHeader) == remoteWriteVersion20Header {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		}
+	}))
+	defer testServer.Close()
+
+	logger, records := newRecordingLogger()
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+		LabelValidationOption(LabelValidationLenient),
+		LoggerOption(logger),
+	))
+	require.NoError(t, err)
+
+	tsList := append(TSList{{Labels: []Label{{Name: "job", Value: "api"}}}}, retryTestTSList...)
+	for i := 0; i < 2; i++ {
+		_, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+		require.NoError(t, writeErr)
+	}
+
+	var invalid, downgrades int
+	for _, r := range records() {
+		switch r.msg {
+		case "Dropped series with invalid labels":
+			invalid++
+			assert.Equal(t, slog.LevelWarn, r.level)
+			assert.Equal(t, int64(1), r.attrs["series"].Int64())
+		case "Endpoint does not support Remote Write 2.0, downgrading to Remote Write 1.0":
+			downgrades++
+		case "Remote write failed":
+			t.Errorf("downgraded write logged as failed")
+		}
+	}
+	assert.Equal(t, 2, invalid)
+	assert.Equal(t, 1, downgrades)
+}
+
+func TestQueueWriterLogsDroppedSeries(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(WriteURLOption(testServer.URL)))
+	require.NoError(t, err)
+
+	logger, records := newRecordingLogger()
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:          100,
+		MaxSamplesPerSend: 10,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         1,
+		Logger:            logger,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	require.NoError(t, q.Close(context.Background()))
+
+	require.Len(t, records(), 1)
+	r := records()[0]
+	assert.Equal(t, "Dropped series of failed write", r.msg)
+	assert.Equal(t, int64(http.StatusBadRequest), r.attrs["status"].Int64())
+	assert.Equal(t, int64(2), r.attrs["samples"].Int64())
+}
+
+func TestTruncateBody(t *testing.T) {
+	assert.Equal(t, "short", truncateBody([]byte("short")))
+
+	// A multi-byte character straddling the limit is left out whole.
+	body := strings.Repeat("a", maxLoggedBodyBytes-1) + "é"
+	assert.Equal(t, strings.Repeat("a", maxLoggedBodyBytes-1)+"...", truncateBody([]byte(body)))
+}
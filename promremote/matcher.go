@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MatchType is the type of a label matcher.
+type MatchType = prompb.LabelMatcher_Type
+
+// MatchType values.
+const (
+	MatchEqual     MatchType = prompb.LabelMatcher_EQ
+	MatchNotEqual  MatchType = prompb.LabelMatcher_NEQ
+	MatchRegexp    MatchType = prompb.LabelMatcher_RE
+	MatchNotRegexp MatchType = prompb.LabelMatcher_NRE
+)
+
+// NewMatcher returns a label matcher for remote read queries. It returns an error if
+// the match type is unknown, the label name is invalid or, for regexp matchers, if
+// the value does not compile.
+func NewMatcher(t MatchType, name, value string) (*prompb.LabelMatcher, error) {
+	matchType, ok := fromPromMatchType(t)
+	if !ok {
+		return nil, fmt.Errorf("invalid match type: %d", t)
+	}
+
+	if !model.LabelName(name).IsValid() {
+		return nil, fmt.Errorf("invalid label name: %q", name)
+	}
+
+	if _, err := labels.NewMatcher(matchType, name, value); err != nil {
+		return nil, fmt.Errorf("invalid matcher for label %q: %v", name, err)
+	}
+
+	return &prompb.LabelMatcher{Type: t, Name: name, Value: value}, nil
+}
+
+// ParseSelector parses a PromQL series selector such as
+// `http_requests_total{job!="test", code=~"5.."}` into label matchers.
+// Like Prometheus, it rejects selectors in which every matcher matches the empty
+// string since they would select every series.
+func ParseSelector(selector string) ([]*prompb.LabelMatcher, error) {
+	parsed, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %v", selector, err)
+	}
+
+	if err := validateMatchers(parsed); err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %v", selector, err)
+	}
+
+	matchers := make([]*prompb.LabelMatcher, 0, len(parsed))
+	for _, m := range parsed {
+		matchers = append(matchers, &prompb.LabelMatcher{
+			Type:  toPromMatchType(m.Type),
+			Name:  m.Name,
+			Value: m.Value,
+		})
+	}
+
+	return matchers, nil
+}
+
+func validateMatchers(matchers []*labels.Matcher) error {
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return nil
+		}
+	}
+
+	return errors.New("at least one matcher must not match the empty string")
+}
+
+func toPromMatchType(t labels.MatchType) MatchType {
+	switch t {
+	case labels.MatchNotEqual:
+		return MatchNotEqual
+	case labels.MatchRegexp:
+		return MatchRegexp
+	case labels.MatchNotRegexp:
+		return MatchNotRegexp
+	default:
+		return MatchEqual
+	}
+}
+
+func fromPromMatchType(t MatchType) (labels.MatchType, bool) {
+	switch t {
+	case MatchEqual:
+		return labels.MatchEqual, true
+	case MatchNotEqual:
+		return labels.MatchNotEqual, true
+	case MatchRegexp:
+		return labels.MatchRegexp, true
+	case MatchNotRegexp:
+		return labels.MatchNotRegexp, true
+	default:
+		return 0, false
+	}
+}
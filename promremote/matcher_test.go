@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	matchers, err := ParseSelector(`{__name__=~"http_.*", job!="test"}`)
+	require.NoError(t, err)
+	assert.Equal(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "http_.*"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "test"},
+	}, matchers)
+
+	matchers, err = ParseSelector(`http_requests_total{code!~"2..", env="prod"}`)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+		{Type: prompb.LabelMatcher_NRE, Name: "code", Value: "2.."},
+		{Type: prompb.LabelMatcher_EQ, Name: "env", Value: "prod"},
+	}, matchers)
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		``,
+		`{job="test"`,
+		`{job=~"(unclosed"}`,
+		`rate(foo[5m])`,
+		`{job!="test"}`,
+		`{job=~".*"}`,
+	} {
+		_, err := ParseSelector(selector)
+		assert.Error(t, err, selector)
+	}
+}
+
+func TestNewMatcher(t *testing.T) {
+	m, err := NewMatcher(MatchRegexp, "job", "api|web")
+	require.NoError(t, err)
+	assert.Equal(t, &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|web"}, m)
+
+	_, err = NewMatcher(MatchEqual, "", "foo")
+	assert.Error(t, err)
+
+	_, err = NewMatcher(MatchEqual, "\xff", "foo")
+	assert.Error(t, err)
+
+	_, err = NewMatcher(MatchNotRegexp, "job", "(unclosed")
+	assert.Error(t, err)
+
+	_, err = NewMatcher(MatchType(42), "job", "api")
+	assert.Error(t, err)
+}
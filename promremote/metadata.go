@@ -0,0 +1,234 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// MetricType is the type of a metric as defined by Prometheus.
+type MetricType string
+
+// Metric types supported by Prometheus.
+const (
+	MetricTypeUnknown        MetricType = "unknown"
+	MetricTypeCounter        MetricType = "counter"
+	MetricTypeGauge          MetricType = "gauge"
+	MetricTypeHistogram      MetricType = "histogram"
+	MetricTypeGaugeHistogram MetricType = "gaugehistogram"
+	MetricTypeSummary        MetricType = "summary"
+	MetricTypeInfo           MetricType = "info"
+	MetricTypeStateset       MetricType = "stateset"
+)
+
+// Metadata describes the metric a series belongs to.
+type Metadata struct {
+	Type MetricType
+	Help string
+	Unit string
+}
+
+// MetricMetadata describes a metric family.
+type MetricMetadata struct {
+	MetricFamilyName string
+	Type             MetricType
+	Help             string
+	Unit             string
+}
+
+// MetadataList is a slice of MetricMetadata.
+type MetadataList []MetricMetadata
+
+// MetadataSender periodically writes metric metadata separately from samples,
+// the way Prometheus sends metadata on its own cadence.
+type MetadataSender struct {
+	client   MetadataWriter
+	interval time.Duration
+	metadata func() MetadataList
+	opts     WriteOptions
+	onError  func(WriteError)
+}
+
+// NewMetadataSender creates a sender that writes the metadata returned by the
+// metadata function through the client every interval. Write errors are passed
+// to onError, which may be nil.
+func NewMetadataSender(
+	c MetadataWriter,
+	interval time.Duration,
+	metadata func() MetadataList,
+	opts WriteOptions,
+	onError func(WriteError),
+) (*MetadataSender, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("metadata send interval should be greater than 0: %d", interval)
+	}
+
+	return &MetadataSender{
+		client:   c,
+		interval: interval,
+		metadata: metadata,
+		opts:     opts,
+		onError:  onError,
+	}, nil
+}
+
+// Run writes the metadata right away and then every interval until the context
+// is done. Writes failing once the context is done are not passed to onError.
+func (s *MetadataSender) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if md := s.metadata(); len(md) > 0 {
+			if _, err := s.client.WriteMetadata(ctx, md, s.opts); err != nil && ctx.Err() == nil && s.onError != nil {
+				s.onError(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// toPromWriteRequest converts a metadata list to a Prometheus proto write request without series.
+func (m MetadataList) toPromWriteRequest() *prompb.WriteRequest {
+	metadata := make([]prompb.MetricMetadata, len(m))
+	for i, md := range m {
+		metadata[i] = prompb.MetricMetadata{
+			Type:             md.Type.toProm(),
+			MetricFamilyName: md.MetricFamilyName,
+			Help:             md.Help,
+			Unit:             md.Unit,
+		}
+	}
+
+	return &prompb.WriteRequest{Metadata: metadata}
+}
+
+// seriesMetadata returns one metric metadata entry per metric family of the
+// series list that has metadata set.
+func (t TSList) seriesMetadata() []prompb.MetricMetadata {
+	var metadata []prompb.MetricMetadata
+	seen := make(map[string]struct{})
+
+	for _, ts := range t {
+		if ts.Metadata == (Metadata{}) {
+			continue
+		}
+
+		var name string
+		for _, label := range ts.Labels {
+			if label.Name == "__name__" {
+				name = metricFamilyName(label.Value, ts.Metadata.Type)
+				break
+			}
+		}
+		if _, ok := seen[name]; ok || name == "" {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		metadata = append(metadata, prompb.MetricMetadata{
+			Type:             ts.Metadata.Type.toProm(),
+			MetricFamilyName: name,
+			Help:             ts.Metadata.Help,
+			Unit:             ts.Metadata.Unit,
+		})
+	}
+
+	return metadata
+}
+
+// metricFamilyName strips the suffixes classic histograms and summaries add
+// to the names of their series.
+func metricFamilyName(name string, t MetricType) string {
+	var suffixes []string
+	switch t {
+	case MetricTypeHistogram, MetricTypeGaugeHistogram:
+		suffixes = []string{"_bucket", "_sum", "_count"}
+	case MetricTypeSummary:
+		suffixes = []string{"_sum", "_count"}
+	}
+
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+
+	return name
+}
+
+func (t MetricType) toProm() prompb.MetricMetadata_MetricType {
+	// Both enums share the values of the Prometheus metric types.
+	return prompb.MetricMetadata_MetricType(t.toWriteV2())
+}
+
+func (t MetricType) toWriteV2() writev2.Metadata_MetricType {
+	switch t {
+	case MetricTypeCounter:
+		return writev2.Metadata_METRIC_TYPE_COUNTER
+	case MetricTypeGauge:
+		return writev2.Metadata_METRIC_TYPE_GAUGE
+	case MetricTypeHistogram:
+		return writev2.Metadata_METRIC_TYPE_HISTOGRAM
+	case MetricTypeGaugeHistogram:
+		return writev2.Metadata_METRIC_TYPE_GAUGEHISTOGRAM
+	case MetricTypeSummary:
+		return writev2.Metadata_METRIC_TYPE_SUMMARY
+	case MetricTypeInfo:
+		return writev2.Metadata_METRIC_TYPE_INFO
+	case MetricTypeStateset:
+		return writev2.Metadata_METRIC_TYPE_STATESET
+	default:
+		return writev2.Metadata_METRIC_TYPE_UNSPECIFIED
+	}
+}
+
+func metricTypeFromWriteV2(t writev2.Metadata_MetricType) MetricType {
+	switch t {
+	case writev2.Metadata_METRIC_TYPE_COUNTER:
+		return MetricTypeCounter
+	case writev2.Metadata_METRIC_TYPE_GAUGE:
+		return MetricTypeGauge
+	case writev2.Metadata_METRIC_TYPE_HISTOGRAM:
+		return MetricTypeHistogram
+	case writev2.Metadata_METRIC_TYPE_GAUGEHISTOGRAM:
+		return MetricTypeGaugeHistogram
+	case writev2.Metadata_METRIC_TYPE_SUMMARY:
+		return MetricTypeSummary
+	case writev2.Metadata_METRIC_TYPE_INFO:
+		return MetricTypeInfo
+	case writev2.Metadata_METRIC_TYPE_STATESET:
+		return MetricTypeStateset
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromRemoteClientWriteMetadata(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+
+		wr := decodeWriteRequest(t, r)
+		assert.Empty(t, wr.Timeseries)
+		assert.Equal(t, []prompb.MetricMetadata{
+			{
+				Type:             prompb.MetricMetadata_COUNTER,
+				MetricFamilyName: "http_requests_total",
+				Help:             "Total HTTP requests.",
+			},
+			{
+				Type:             prompb.MetricMetadata_HISTOGRAM,
+				MetricFamilyName: "http_request_duration_seconds",
+				Help:             "HTTP request latency.",
+				Unit:             "seconds",
+			},
+		}, wr.Metadata)
+	}))
+
+	defer testServer.Close()
+
+	// Metadata is sent as Remote Write 1.0 even when the client prefers 2.0.
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+	))
+	require.NoError(t, err)
+
+	r, writeErr := c.(MetadataWriter).WriteMetadata(context.Background(), MetadataList{
+		{
+			MetricFamilyName: "http_requests_total",
+			Type:             MetricTypeCounter,
+			Help:             "Total HTTP requests.",
+		},
+		{
+			MetricFamilyName: "http_request_duration_seconds",
+			Type:             MetricTypeHistogram,
+			Help:             "HTTP request latency.",
+			Unit:             "seconds",
+		},
+	}, WriteOptions{})
+	require.NoError(t, writeErr)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestToPromWriteRequestSeriesMetadata(t *testing.T) {
+	histogramMetadata := Metadata{Type: MetricTypeHistogram, Help: "HTTP request latency.", Unit: "seconds"}
+	tsList := TSList{
+		{
+			Labels:    []Label{{Name: "__name__", Value: "http_request_duration_seconds_bucket"}, {Name: "le", Value: "0.1"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 3},
+			Metadata:  histogramMetadata,
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "http_request_duration_seconds_sum"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 0.4},
+			Metadata:  histogramMetadata,
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "up"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 1},
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "temperature_celsius"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 21.5},
+			Metadata:  Metadata{Type: MetricTypeGauge, Unit: "celsius"},
+		},
+	}
+
+	wr, err := tsList.toPromWriteRequest()
+	require.NoError(t, err)
+
+	assert.Equal(t, []prompb.MetricMetadata{
+		{
+			Type:             prompb.MetricMetadata_HISTOGRAM,
+			MetricFamilyName: "http_request_duration_seconds",
+			Help:             "HTTP request latency.",
+			Unit:             "seconds",
+		},
+		{
+			Type:             prompb.MetricMetadata_GAUGE,
+			MetricFamilyName: "temperature_celsius",
+			Unit:             "celsius",
+		},
+	}, wr.Metadata)
+}
+
+func TestMetricFamilyName(t *testing.T) {
+	tests := []struct {
+		name       string
+		metricType MetricType
+		expected   string
+	}{
+		{name: "rpc_seconds_bucket", metricType: MetricTypeHistogram, expected: "rpc_seconds"},
+		{name: "rpc_seconds_count", metricType: MetricTypeGaugeHistogram, expected: "rpc_seconds"},
+		{name: "rpc_seconds_sum", metricType: MetricTypeSummary, expected: "rpc_seconds"},
+		{name: "rpc_seconds_bucket", metricType: MetricTypeSummary, expected: "rpc_seconds_bucket"},
+		{name: "requests_total", metricType: MetricTypeCounter, expected: "requests_total"},
+		{name: "items_count", metricType: MetricTypeGauge, expected: "items_count"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, metricFamilyName(test.name, test.metricType), test.name)
+	}
+}
+
+func TestMetadataSender(t *testing.T) {
+	var writes atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wr := decodeWriteRequest(t, r)
+		assert.Len(t, wr.Metadata, 1)
+		if writes.Add(1) == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(WriteURLOption(testServer.URL)))
+	require.NoError(t, err)
+
+	var errs atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	sender, err := NewMetadataSender(c.(MetadataWriter), 10*time.Millisecond, func() MetadataList {
+		return MetadataList{{MetricFamilyName: "up", Type: MetricTypeGauge}}
+	}, WriteOptions{}, func(err WriteError) {
+		assert.Equal(t, http.StatusInternalServerError, err.StatusCode())
+		errs.Add(1)
+	})
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- sender.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool { return writes.Load() >= 3 }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	assert.Equal(t, int32(1), errs.Load())
+}
+
+func TestNewMetadataSenderInterval(t *testing.T) {
+	c, err := NewClient(NewConfig())
+	require.NoError(t, err)
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		_, err := NewMetadataSender(c.(MetadataWriter), interval, func() MetadataList { return nil }, WriteOptions{}, nil)
+		require.Error(t, err)
+	}
+}
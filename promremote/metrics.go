@@ -0,0 +1,236 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const metricsNamespace = "promremote"
+
+// Metrics are the self-instrumentation metrics of clients and queue writers.
+// A single Metrics can be shared by several clients, whose metrics are told
+// apart by the `url` label, and is registered like any other collector:
+//
+//	metrics := promremote.NewMetrics()
+//	prometheus.MustRegister(metrics)
+type Metrics struct {
+	samplesSent    *prometheus.CounterVec
+	samplesFailed  *prometheus.CounterVec
+	samplesRetried *prometheus.CounterVec
+	seriesSent     *prometheus.CounterVec
+	seriesFailed   *prometheus.CounterVec
+	seriesRetried  *prometheus.CounterVec
+	bytesSent      *prometheus.CounterVec
+	bytesFailed    *prometheus.CounterVec
+	bytesRetried   *prometheus.CounterVec
+
+	requestDuration  *prometheus.HistogramVec
+	lastSend         *prometheus.GaugeVec
+	compressionRatio *prometheus.GaugeVec
+
+	queuePendingSamples prometheus.Gauge
+}
+
+// NewMetrics creates the self-instrumentation metrics.
+func NewMetrics() *Metrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"url"})
+	}
+
+	return &Metrics{
+		samplesSent:    counter("samples_sent_total", "Total number of samples and histograms written."),
+		samplesFailed:  counter("samples_failed_total", "Total number of samples and histograms whose write failed."),
+		samplesRetried: counter("samples_retried_total", "Total number of samples and histograms whose write was retried."),
+		seriesSent:     counter("series_sent_total", "Total number of series written."),
+		seriesFailed:   counter("series_failed_total", "Total number of series whose write failed."),
+		seriesRetried:  counter("series_retried_total", "Total number of series whose write was retried."),
+		bytesSent:      counter("bytes_sent_total", "Total number of compressed payload bytes written."),
+		bytesFailed:    counter("bytes_failed_total", "Total number of compressed payload bytes whose write failed."),
+		bytesRetried:   counter("bytes_retried_total", "Total number of compressed payload bytes whose write was retried."),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of remote write HTTP requests, including failed ones.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"url"}),
+		lastSend: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "last_send_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful write.",
+		}, []string{"url"}),
+		compressionRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "compression_ratio",
+			Help:      "Ratio of the uncompressed to the compressed payload size of the last write.",
+		}, []string{"url"}),
+		queuePendingSamples: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_pending_samples",
+			Help:      "Number of samples and histograms queued in queue writers and not yet written.",
+		}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.samplesSent, m.samplesFailed, m.samplesRetried,
+		m.seriesSent, m.seriesFailed, m.seriesRetried,
+		m.bytesSent, m.bytesFailed, m.bytesRetried,
+		m.requestDuration, m.lastSend, m.compressionRatio,
+		m.queuePendingSamples,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// addQueued adds the number of samples to the queue length; m may be nil.
+func (m *Metrics) addQueued(samples int) {
+	if m != nil {
+		m.queuePendingSamples.Add(float64(samples))
+	}
+}
+
+// endpoint returns the metrics of the client writing to the URL, or nil if m is nil.
+func (m *Metrics) endpoint(url string) *endpointMetrics {
+	if m == nil {
+		return nil
+	}
+
+	return &endpointMetrics{
+		samplesSent:      m.samplesSent.WithLabelValues(url),
+		samplesFailed:    m.samplesFailed.WithLabelValues(url),
+		samplesRetried:   m.samplesRetried.WithLabelValues(url),
+		seriesSent:       m.seriesSent.WithLabelValues(url),
+		seriesFailed:     m.seriesFailed.WithLabelValues(url),
+		seriesRetried:    m.seriesRetried.WithLabelValues(url),
+		bytesSent:        m.bytesSent.WithLabelValues(url),
+		bytesFailed:      m.bytesFailed.WithLabelValues(url),
+		bytesRetried:     m.bytesRetried.WithLabelValues(url),
+		requestDuration:  m.requestDuration.WithLabelValues(url),
+		lastSend:         m.lastSend.WithLabelValues(url),
+		compressionRatio: m.compressionRatio.WithLabelValues(url),
+	}
+}
+
+// endpointMetrics are the metrics of a single client. All methods are no-ops
+// on a nil receiver, so that clients without metrics need no checks.
+type endpointMetrics struct {
+	samplesSent, samplesFailed, samplesRetried prometheus.Counter
+	seriesSent, seriesFailed, seriesRetried    prometheus.Counter
+	bytesSent, bytesFailed, bytesRetried       prometheus.Counter
+
+	requestDuration  prometheus.Observer
+	lastSend         prometheus.Gauge
+	compressionRatio prometheus.Gauge
+}
+
+// writeStats are the size of a write request.
+type writeStats struct {
+	series  int
+	samples int
+	// uncompressed and compressed are the sizes of the payload in bytes.
+	uncompressed int
+	compressed   int
+}
+
+func promWriteRequestStats(req *prompb.WriteRequest) writeStats {
+	stats := writeStats{series: len(req.Timeseries)}
+	for _, ts := range req.Timeseries {
+		stats.samples += len(ts.Samples) + len(ts.Histograms)
+	}
+
+	return stats
+}
+
+func writeV2RequestStats(req *writev2.Request) writeStats {
+	stats := writeStats{series: len(req.Timeseries)}
+	for _, ts := range req.Timeseries {
+		stats.samples += len(ts.Samples) + len(ts.Histograms)
+	}
+
+	return stats
+}
+
+func (m *endpointMetrics) encoded(stats writeStats) {
+	if m == nil || stats.compressed == 0 {
+		return
+	}
+
+	m.compressionRatio.Set(float64(stats.uncompressed) / float64(stats.compressed))
+}
+
+func (m *endpointMetrics) requestDone(d time.Duration) {
+	if m != nil {
+		m.requestDuration.Observe(d.Seconds())
+	}
+}
+
+func (m *endpointMetrics) sent(stats writeStats) {
+	if m == nil {
+		return
+	}
+
+	m.samplesSent.Add(float64(stats.samples))
+	m.seriesSent.Add(float64(stats.series))
+	m.bytesSent.Add(float64(stats.compressed))
+	m.lastSend.SetToCurrentTime()
+}
+
+func (m *endpointMetrics) failed(stats writeStats) {
+	if m == nil {
+		return
+	}
+
+	m.samplesFailed.Add(float64(stats.samples))
+	m.seriesFailed.Add(float64(stats.series))
+	m.bytesFailed.Add(float64(stats.compressed))
+}
+
+func (m *endpointMetrics) retried(stats writeStats) {
+	if m == nil {
+		return
+	}
+
+	m.samplesRetried.Add(float64(stats.samples))
+	m.seriesRetried.Add(float64(stats.series))
+	m.bytesRetried.Add(float64(stats.compressed))
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRegister(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewMetrics()))
+}
+
+func TestClientMetrics(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+
+	metrics := NewMetrics()
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		RetryOption(RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}),
+		MetricsOption(metrics),
+	))
+	require.NoError(t, err)
+
+	tsList := TSList{
+		testSeries("a", 1),
+		{
+			Labels:     []Label{{Name: "__name__", Value: "b"}},
+			Datapoints: []Datapoint{{Timestamp: now, Value: 1}, {Timestamp: now.Add(time.Second), Value: 2}},
+		},
+	}
+
+	before := time.Now()
+	_, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.Error(t, writeErr)
+
+	url := testServer.URL
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.samplesSent.WithLabelValues(url)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.seriesSent.WithLabelValues(url)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.samplesRetried.WithLabelValues(url)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.seriesRetried.WithLabelValues(url)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.samplesFailed.WithLabelValues(url)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.seriesFailed.WithLabelValues(url)))
+
+	bytesSent := testutil.ToFloat64(metrics.bytesSent.WithLabelValues(url))
+	assert.Greater(t, bytesSent, 0.0)
+	assert.Equal(t, bytesSent, testutil.ToFloat64(metrics.bytesRetried.WithLabelValues(url)))
+	assert.Equal(t, bytesSent, testutil.ToFloat64(metrics.bytesFailed.WithLabelValues(url)))
+
+	assert.Greater(t, testutil.ToFloat64(metrics.compressionRatio.WithLabelValues(url)), 0.0)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.lastSend.WithLabelValues(url)), float64(before.Unix()))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.requestDuration))
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(metrics))
+	count, err := testutil.GatherAndCount(reg, "promremote_request_duration_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestQueueWriterMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	q, err := NewQueueWriter(&recordingClient{}, QueueConfig{
+		Capacity:          100,
+		MaxSamplesPerSend: 10,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         1,
+		Metrics:           metrics,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.queuePendingSamples))
+
+	require.NoError(t, q.Flush(context.Background()))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.queuePendingSamples))
+
+	require.NoError(t, q.Close(context.Background()))
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2 configures the OAuth2 client credentials flow. Exactly one of
+// ClientSecret or ClientSecretFile may be set.
+type OAuth2 struct {
+	ClientID     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+
+	// ClientSecretFile is read on every request and reloaded whenever it changes.
+	ClientSecretFile string `yaml:"clientSecretFile"`
+
+	// TokenURL is the URL access tokens are requested from.
+	TokenURL string `yaml:"tokenURL"`
+
+	// Scopes are the scopes requested for access tokens.
+	Scopes []string `yaml:"scopes"`
+
+	// EndpointParams are additional parameters sent to the token URL.
+	EndpointParams map[string]string `yaml:"endpointParams"`
+}
+
+func (o OAuth2) validate() error {
+	if o.ClientID == "" {
+		return errors.New("oauth2 client ID should not be blank")
+	}
+
+	if o.TokenURL == "" {
+		return errors.New("oauth2 token URL should not be blank")
+	}
+
+	if o.ClientSecret != "" && o.ClientSecretFile != "" {
+		return errors.New("at most one of oauth2 client secret and client secret file should be set")
+	}
+
+	return nil
+}
+
+// oauth2Authorizer sets access tokens on requests. Tokens are cached until they
+// expire, and a new token source is built whenever the client secret changes.
+type oauth2Authorizer struct {
+	cfg        OAuth2
+	secret     *secret
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	clientSecret string
+	source       oauth2.TokenSource
+}
+
+func newOAuth2Authorizer(cfg OAuth2, httpClient *http.Client) *oauth2Authorizer {
+	return &oauth2Authorizer{
+		cfg:        cfg,
+		secret:     newSecret(cfg.ClientSecret, cfg.ClientSecretFile),
+		httpClient: httpClient,
+	}
+}
+
+func (a *oauth2Authorizer) authorize(req *http.Request) error {
+	clientSecret, err := a.secret.get()
+	if err != nil {
+		return err
+	}
+
+	token, err := a.tokenSource(clientSecret).Token()
+	if err != nil {
+		return fmt.Errorf("unable to fetch oauth2 token: %v", err)
+	}
+
+	token.SetAuthHeader(req)
+	return nil
+}
+
+func (a *oauth2Authorizer) tokenSource(clientSecret string) oauth2.TokenSource {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.source != nil && a.clientSecret == clientSecret {
+		return a.source
+	}
+
+	params := url.Values{}
+	for k, v := range a.cfg.EndpointParams {
+		params.Set(k, v)
+	}
+
+	cc := &clientcredentials.Config{
+		ClientID:       a.cfg.ClientID,
+		ClientSecret:   clientSecret,
+		TokenURL:       a.cfg.TokenURL,
+		Scopes:         a.cfg.Scopes,
+		EndpointParams: params,
+	}
+
+	a.clientSecret = clientSecret
+	a.source = cc.TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, a.httpClient))
+
+	return a.source
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type oauth2TestServer struct {
+	*httptest.Server
+
+	expiresIn int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newOAuth2TestServer(t *testing.T, expiresIn int) *oauth2TestServer {
+	s := &oauth2TestServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		issued := len(s.requests)
+		s.mu.Unlock()
+
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "client" || clientSecret == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("%s-%d", clientSecret, issued),
+			"token_type":   "Bearer",
+			"expires_in":   s.expiresIn,
+		})
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *oauth2TestServer) tokenRequests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+func TestClientOAuth2(t *testing.T) {
+	tokenServer := newOAuth2TestServer(t, 3600)
+	testServer, headers := newAuthTestServer(t)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		OAuth2Option(OAuth2{
+			ClientID:       "client",
+			ClientSecret:   "secret",
+			TokenURL:       tokenServer.URL,
+			Scopes:         []string{"metrics:write", "metrics:read"},
+			EndpointParams: map[string]string{"audience": "mimir"},
+		}),
+	))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+		require.NoError(t, writeErr)
+	}
+
+	assert.Equal(t, []string{"Bearer secret-1", "Bearer secret-1"}, headers())
+
+	requests := tokenServer.tokenRequests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "client_credentials", requests[0].PostForm.Get("grant_type"))
+	assert.Equal(t, "metrics:write metrics:read", requests[0].PostForm.Get("scope"))
+	assert.Equal(t, "mimir", requests[0].PostForm.Get("audience"))
+}
+
+func TestClientOAuth2RefreshesExpiredTokens(t *testing.T) {
+	// Tokens expiring within the oauth2 package's expiry delta are refreshed on every request.
+	tokenServer := newOAuth2TestServer(t, 1)
+	testServer, headers := newAuthTestServer(t)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		OAuth2Option(OAuth2{ClientID: "client", ClientSecret: "secret", TokenURL: tokenServer.URL}),
+	))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+		require.NoError(t, writeErr)
+	}
+
+	assert.Equal(t, []string{"Bearer secret-1", "Bearer secret-2"}, headers())
+}
+
+func TestClientOAuth2ClientSecretFile(t *testing.T) {
+	tokenServer := newOAuth2TestServer(t, 3600)
+	testServer, headers := newAuthTestServer(t)
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("first\n"), 0600))
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		OAuth2Option(OAuth2{ClientID: "client", ClientSecretFile: secretFile, TokenURL: tokenServer.URL}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.NoError(t, os.WriteFile(secretFile, []byte("second\n"), 0600))
+	require.NoError(t, os.Chtimes(secretFile, time.Now(), time.Now().Add(time.Minute)))
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	assert.Equal(t, []string{"Bearer first-1", "Bearer second-2"}, headers())
+}
+
+func TestClientOAuth2TokenError(t *testing.T) {
+	tokenServer := newOAuth2TestServer(t, 3600)
+	testServer, headers := newAuthTestServer(t)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		OAuth2Option(OAuth2{ClientID: "unknown", ClientSecret: "secret", TokenURL: tokenServer.URL}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Contains(t, writeErr.Error(), "unable to fetch oauth2 token")
+	assert.Empty(t, headers())
+}
+
+func TestValidateConfigOAuth2(t *testing.T) {
+	tests := []OAuth2{
+		{TokenURL: "http://localhost/token"},
+		{ClientID: "client"},
+		{ClientID: "client", TokenURL: "http://localhost/token", ClientSecret: "secret", ClientSecretFile: "/secret"},
+	}
+
+	for _, oauth2 := range tests {
+		_, err := NewClient(NewConfig(OAuth2Option(oauth2)))
+		require.Error(t, err, "%+v", oauth2)
+	}
+
+	_, err := NewClient(NewConfig(
+		OAuth2Option(OAuth2{ClientID: "client", TokenURL: "http://localhost/token"}),
+		BearerTokenOption("token"),
+	))
+	require.Error(t, err)
+}
@@ -0,0 +1,779 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when appending series would exceed the queue capacity.
+	ErrQueueFull = errors.New("queue is full")
+
+	// ErrQueueClosed is returned when appending series to a closed queue.
+	ErrQueueClosed = errors.New("queue is closed")
+)
+
+// shardTolerance is the fraction by which the desired number of shards must
+// differ from the current one before the queue reshards.
+const shardTolerance = 0.3
+
+// walEnqueueBackoff is how long the WAL reader waits for a full shard to have capacity.
+const walEnqueueBackoff = 10 * time.Millisecond
+
+// walMinLimitsInterval is the shortest interval at which the WAL max age is checked.
+const walMinLimitsInterval = 100 * time.Millisecond
+
+// DefaultQueueConfig is the default configuration used to construct a queue writer.
+var DefaultQueueConfig = QueueConfig{
+	Capacity:            10000,
+	MaxSamplesPerSend:   2000,
+	BatchSendDeadline:   5 * time.Second,
+	MinShards:           1,
+	MaxShards:           50,
+	ShardUpdateInterval: 10 * time.Second,
+}
+
+// QueueConfig defines the configuration used to construct a queue writer.
+type QueueConfig struct {
+	// Capacity is the maximum number of samples buffered per shard before Append rejects series.
+	Capacity int `yaml:"capacity"`
+
+	// MaxSamplesPerSend is the maximum number of samples per write.
+	MaxSamplesPerSend int `yaml:"maxSamplesPerSend"`
+
+	// BatchSendDeadline is the maximum time samples wait in a shard before being written.
+	BatchSendDeadline time.Duration `yaml:"batchSendDeadline"`
+
+	// MinShards is the minimum number of shards writing concurrently, and the number the queue starts with.
+	MinShards int `yaml:"minShards"`
+
+	// MaxShards is the maximum number of shards writing concurrently.
+	MaxShards int `yaml:"maxShards"`
+
+	// ShardUpdateInterval is how often the number of shards is scaled to the
+	// observed write latency and incoming sample rate.
+	ShardUpdateInterval time.Duration `yaml:"shardUpdateInterval"`
+
+	// WriteOptions are used for every write.
+	WriteOptions WriteOptions `yaml:"-"`
+
+	// WAL, if not nil, makes the queue keep appended series in an on-disk
+	// write-ahead log until they are written, rather than only in memory.
+	WAL *WALConfig `yaml:"wal"`
+
+	// OnError, if not nil, is called with the error of every failed write.
+	// The series of a failed write are dropped, unless they are kept in a WAL
+	// and the error is recoverable. It may be called concurrently.
+	OnError func(WriteError) `yaml:"-"`
+
+	// Metrics, if not nil, records the number of samples pending in the queue.
+	Metrics *Metrics `yaml:"-"`
+
+	// Logger, if not nil, logs dropped series and resharding.
+	Logger *slog.Logger `yaml:"-"`
+}
+
+func (c QueueConfig) validate() error {
+	if c.MaxSamplesPerSend <= 0 {
+		return fmt.Errorf("max samples per send should be greater than 0: %d", c.MaxSamplesPerSend)
+	}
+
+	if c.Capacity < c.MaxSamplesPerSend {
+		return fmt.Errorf("queue capacity should not be less than max samples per send: %d", c.Capacity)
+	}
+
+	if c.BatchSendDeadline <= 0 {
+		return fmt.Errorf("batch send deadline should be greater than 0: %d", c.BatchSendDeadline)
+	}
+
+	if c.MinShards <= 0 {
+		return fmt.Errorf("min shards should be greater than 0: %d", c.MinShards)
+	}
+
+	if c.MaxShards < c.MinShards {
+		return fmt.Errorf("max shards should not be less than min shards: %d", c.MaxShards)
+	}
+
+	if c.MaxShards > c.MinShards && c.ShardUpdateInterval <= 0 {
+		return fmt.Errorf("shard update interval should be greater than 0: %d", c.ShardUpdateInterval)
+	}
+
+	if c.WAL != nil {
+		return c.WAL.validate()
+	}
+
+	return nil
+}
+
+// QueueWriter batches series appended by callers and writes them through a
+// Client from background shards, so that callers never wait on HTTP.
+//
+// Series are assigned to shards by the hash of their labels, so the samples
+// of a series are written in the order they were appended. The number of
+// shards is scaled between MinShards and MaxShards, like Prometheus's remote
+// write queue does, so that writes keep up with the incoming sample rate.
+//
+// With a WAL, Append writes series to disk and a reader feeds them to the
+// shards, so that series survive restarts and receiver outages.
+type QueueWriter struct {
+	client Client
+	cfg    QueueConfig
+	wal    *wal
+	logger *slog.Logger
+
+	mtx    sync.RWMutex
+	shards []*shard
+	closed bool
+
+	// samplesIn, samplesOut and sendNanos are reset on every shard update.
+	samplesIn  atomic.Int64
+	samplesOut atomic.Int64
+	sendNanos  atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+
+	// stopRead and readDone stop the WAL reader.
+	stopRead chan struct{}
+	readDone chan struct{}
+
+	// sendCtx is cancelled to abort in-flight writes when Close times out.
+	sendCtx    context.Context
+	cancelSend context.CancelFunc
+}
+
+// NewQueueWriter creates a new queue writer and starts its background shards.
+func NewQueueWriter(c Client, cfg QueueConfig) (*QueueWriter, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	q := &QueueWriter{
+		client:     c,
+		cfg:        cfg,
+		logger:     loggerOrDiscard(cfg.Logger),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		stopRead:   make(chan struct{}),
+		readDone:   make(chan struct{}),
+		sendCtx:    sendCtx,
+		cancelSend: cancelSend,
+	}
+
+	if cfg.WAL != nil {
+		w, err := openWAL(*cfg.WAL, q.logger)
+		if err != nil {
+			cancelSend()
+			return nil, err
+		}
+		q.wal = w
+		go q.readWAL()
+	} else {
+		close(q.readDone)
+	}
+
+	started := make(chan struct{})
+	close(started)
+	q.shards = q.newShards(cfg.MinShards, started)
+
+	go q.run()
+
+	return q, nil
+}
+
+// Append queues series to be written. It never blocks on writes and returns
+// ErrQueueFull, without queueing any of the series, if a shard is out of capacity.
+// A single series with more samples than the capacity is queued if its shard is empty.
+// With a WAL, it returns once the series are synced to disk and is never out of capacity.
+func (q *QueueWriter) Append(series ...TimeSeries) error {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if q.wal != nil {
+		if err := q.wal.append(series); err != nil {
+			return err
+		}
+
+		samples := 0
+		for _, ts := range series {
+			samples += ts.sampleCount()
+		}
+		q.samplesIn.Add(int64(samples))
+
+		return nil
+	}
+
+	byShard := make(map[int][]queuedSeries)
+	for _, ts := range series {
+		i := q.shardIndex(ts)
+		byShard[i] = append(byShard[i], queuedSeries{TimeSeries: ts})
+	}
+
+	// Lock the shards in order so that concurrent appends cannot deadlock.
+	indexes := make([]int, 0, len(byShard))
+	for i := range byShard {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	samples := make(map[int]int, len(indexes))
+	for _, i := range indexes {
+		s := q.shards[i]
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		for _, qs := range byShard[i] {
+			samples[i] += qs.sampleCount()
+		}
+		// A series larger than the capacity is still queued in an empty shard.
+		oversized := s.pendingSamples == 0 && len(byShard[i]) == 1
+		if s.pendingSamples+samples[i] > q.cfg.Capacity && !oversized {
+			return ErrQueueFull
+		}
+	}
+
+	total := 0
+	for _, i := range indexes {
+		q.shards[i].append(byShard[i], samples[i])
+		total += samples[i]
+	}
+	q.samplesIn.Add(int64(total))
+
+	return nil
+}
+
+// Flush writes all series appended before the call, returning once they have
+// been written or the context is done.
+func (q *QueueWriter) Flush(ctx context.Context) error {
+	q.mtx.RLock()
+	closed := q.closed
+	q.mtx.RUnlock()
+	if closed {
+		return ErrQueueClosed
+	}
+
+	if q.wal != nil {
+		if err := q.waitWALConsumed(ctx.Done()); err != nil {
+			return ctx.Err()
+		}
+	}
+
+	q.mtx.RLock()
+	shards := q.shards
+	q.mtx.RUnlock()
+
+	replies := make([]chan struct{}, len(shards))
+	for i, s := range shards {
+		replies[i] = make(chan struct{})
+		select {
+		case s.flushReqs <- replies[i]:
+		case <-s.done:
+			// The shard was replaced and has written all its series.
+			close(replies[i])
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, reply := range replies {
+		select {
+		case <-reply:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Close stops accepting series and writes the queued ones. If the context is
+// done first, in-flight writes are aborted and the remaining series are dropped.
+func (q *QueueWriter) Close(ctx context.Context) error {
+	q.mtx.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mtx.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.cancelSend()
+		<-q.done
+		return ctx.Err()
+	}
+}
+
+// Shards returns the current number of shards.
+func (q *QueueWriter) Shards() int {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+
+	return len(q.shards)
+}
+
+func (q *QueueWriter) shardIndex(ts TimeSeries) int {
+	return int(labelsHash(ts.Labels) % uint64(len(q.shards)))
+}
+
+// readWAL feeds the series read from the WAL to the shards.
+func (q *QueueWriter) readWAL() {
+	defer close(q.readDone)
+
+	for {
+		series, seg, pos, ok := q.wal.next(q.stopRead)
+		if !ok {
+			return
+		}
+
+		for _, ts := range series {
+			if !q.enqueue(queuedSeries{TimeSeries: ts, segment: seg}) {
+				return
+			}
+		}
+		q.wal.consume(pos)
+	}
+}
+
+// enqueue queues a series read from the WAL, waiting for its shard to have
+// capacity. It returns false if the WAL reader was stopped first.
+func (q *QueueWriter) enqueue(qs queuedSeries) bool {
+	samples := qs.sampleCount()
+
+	for {
+		q.mtx.RLock()
+		s := q.shards[q.shardIndex(qs.TimeSeries)]
+		s.mtx.Lock()
+		// A series larger than the capacity is still queued in an empty shard.
+		ok := s.pendingSamples == 0 || s.pendingSamples+samples <= q.cfg.Capacity
+		if ok {
+			s.append([]queuedSeries{qs}, samples)
+		}
+		s.mtx.Unlock()
+		q.mtx.RUnlock()
+
+		if ok {
+			return true
+		}
+
+		select {
+		case <-time.After(walEnqueueBackoff):
+		case <-q.stopRead:
+			return false
+		}
+	}
+}
+
+// waitWALConsumed waits until all series appended to the WAL have been
+// queued in shards, or done is closed.
+func (q *QueueWriter) waitWALConsumed(done <-chan struct{}) error {
+	pos := q.wal.position()
+	for {
+		consumed, progress := q.wal.consumedUpTo(pos)
+		if consumed {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-done:
+			return context.Canceled
+		}
+	}
+}
+
+// newShards creates and starts n shards, which only write once started is closed.
+func (q *QueueWriter) newShards(n int, started <-chan struct{}) []*shard {
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{
+			q:          q,
+			started:    started,
+			batchReady: make(chan struct{}, 1),
+			flushReqs:  make(chan chan struct{}),
+			stop:       make(chan struct{}),
+			done:       make(chan struct{}),
+		}
+		go shards[i].run()
+	}
+
+	return shards
+}
+
+func (q *QueueWriter) run() {
+	defer close(q.done)
+	defer q.cancelSend()
+
+	var updates <-chan time.Time
+	if q.cfg.MaxShards > q.cfg.MinShards {
+		ticker := time.NewTicker(q.cfg.ShardUpdateInterval)
+		defer ticker.Stop()
+		updates = ticker.C
+	}
+
+	var walLimits <-chan time.Time
+	if q.wal != nil && q.cfg.WAL.MaxAge > 0 {
+		ticker := time.NewTicker(max(q.cfg.WAL.MaxAge/10, walMinLimitsInterval))
+		defer ticker.Stop()
+		walLimits = ticker.C
+	}
+
+	for {
+		select {
+		case <-updates:
+			q.updateShards()
+		case <-walLimits:
+			q.wal.checkLimits()
+		case <-q.stop:
+			if q.wal != nil {
+				// Series still in the WAL once writes are aborted are written after a restart.
+				q.waitWALConsumed(q.sendCtx.Done())
+				close(q.stopRead)
+				<-q.readDone
+			}
+
+			q.mtx.RLock()
+			shards := q.shards
+			q.mtx.RUnlock()
+
+			stopShards(shards)
+
+			if q.wal != nil {
+				q.wal.close()
+			}
+			return
+		}
+	}
+}
+
+// updateShards reshards the queue if the number of shards needed to keep up
+// with the incoming samples differs from the current one.
+func (q *QueueWriter) updateShards() {
+	q.mtx.RLock()
+	current := len(q.shards)
+	pending := 0
+	for _, s := range q.shards {
+		pending += s.pending()
+	}
+	q.mtx.RUnlock()
+
+	desired := desiredShards(shardStats{
+		current:    current,
+		samplesIn:  q.samplesIn.Swap(0),
+		samplesOut: q.samplesOut.Swap(0),
+		sendTime:   time.Duration(q.sendNanos.Swap(0)),
+		pending:    pending,
+		interval:   q.cfg.ShardUpdateInterval,
+	}, q.cfg.MinShards, q.cfg.MaxShards)
+	if desired == current {
+		return
+	}
+
+	q.logger.Info("Resharding queue", "from", current, "to", desired)
+
+	// New shards accept series right away but only write once the old shards
+	// have written theirs, which keeps the samples of each series in order.
+	started := make(chan struct{})
+
+	q.mtx.Lock()
+	old := q.shards
+	q.shards = q.newShards(desired, started)
+	q.mtx.Unlock()
+
+	go func() {
+		stopShards(old)
+		close(started)
+	}()
+}
+
+// stopShards stops the shards, which write their queued series, and waits for them.
+func stopShards(shards []*shard) {
+	for _, s := range shards {
+		close(s.stop)
+	}
+	for _, s := range shards {
+		<-s.done
+	}
+}
+
+// shardStats are the statistics observed over a shard update interval.
+type shardStats struct {
+	current    int
+	samplesIn  int64
+	samplesOut int64
+	sendTime   time.Duration
+	pending    int
+	interval   time.Duration
+}
+
+// desiredShards returns the number of shards needed to write the incoming
+// samples and the pending backlog within an interval, given the time it
+// took to write each sample.
+func desiredShards(s shardStats, minShards, maxShards int) int {
+	// Without writes there is nothing to base the write latency on.
+	if s.samplesOut == 0 {
+		return s.current
+	}
+
+	timePerSample := s.sendTime.Seconds() / float64(s.samplesOut)
+	samplesPerSecond := float64(s.samplesIn+int64(s.pending)) / s.interval.Seconds()
+	desired := timePerSample * samplesPerSecond
+
+	lower := float64(s.current) * (1 - shardTolerance)
+	upper := float64(s.current) * (1 + shardTolerance)
+	if desired >= lower && desired <= upper {
+		return s.current
+	}
+
+	n := int(math.Ceil(desired))
+	if n < minShards {
+		n = minShards
+	}
+	if n > maxShards {
+		n = maxShards
+	}
+
+	return n
+}
+
+// queuedSeries is a series queued in a shard, along with the WAL segment it was read from.
+type queuedSeries struct {
+	TimeSeries
+	segment *walSegment
+}
+
+// shard batches the series of a subset of the queue and writes them sequentially.
+type shard struct {
+	q *QueueWriter
+
+	mtx            sync.Mutex
+	queued         []queuedSeries
+	pendingSamples int
+
+	started    <-chan struct{}
+	batchReady chan struct{}
+	flushReqs  chan chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// append queues series with the given number of samples; s.mtx must be held.
+func (s *shard) append(series []queuedSeries, samples int) {
+	s.queued = append(s.queued, series...)
+	s.pendingSamples += samples
+	s.q.cfg.Metrics.addQueued(samples)
+
+	if s.pendingSamples >= s.q.cfg.MaxSamplesPerSend {
+		select {
+		case s.batchReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *shard) pending() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.pendingSamples
+}
+
+func (s *shard) run() {
+	defer close(s.done)
+
+	select {
+	case <-s.started:
+	case <-s.q.sendCtx.Done():
+	}
+
+	ticker := time.NewTicker(s.q.cfg.BatchSendDeadline)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.batchReady:
+			s.sendBatches(false)
+		case <-ticker.C:
+			s.sendBatches(true)
+		case reply := <-s.flushReqs:
+			s.sendBatches(true)
+			close(reply)
+		case <-s.stop:
+			s.sendBatches(true)
+			return
+		}
+	}
+}
+
+// sendBatches writes the queued series in batches of at most MaxSamplesPerSend
+// samples. Unless all is set, a final partial batch is left queued.
+func (s *shard) sendBatches(all bool) {
+	for {
+		batch, samples := s.nextBatch(all)
+		if len(batch) == 0 {
+			return
+		}
+
+		if s.q.sendCtx.Err() != nil {
+			// Series kept in a WAL are replayed by the next queue writer instead.
+			if s.q.wal != nil {
+				s.q.logger.Info("Left queued series in the WAL after writes were aborted", "series", len(batch), "samples", samples)
+			} else {
+				s.q.logger.Warn("Dropped queued series after writes were aborted", "series", len(batch), "samples", samples)
+			}
+			continue
+		}
+
+		series := make(TSList, len(batch))
+		for i, qs := range batch {
+			series[i] = qs.TimeSeries
+		}
+
+		if s.write(series, samples) && s.q.wal != nil {
+			for _, qs := range batch {
+				s.q.wal.ack(qs.segment, 1)
+			}
+		}
+	}
+}
+
+// write writes a batch, retrying recoverable errors until written if the
+// series are kept in a WAL. It returns false if writes were aborted first.
+func (s *shard) write(series TSList, samples int) bool {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		_, err := s.q.client.WriteTimeSeries(s.q.sendCtx, series, s.q.cfg.WriteOptions)
+		s.q.sendNanos.Add(int64(time.Since(start)))
+		s.q.samplesOut.Add(int64(samples))
+
+		if err == nil {
+			return true
+		}
+
+		if s.q.cfg.OnError != nil {
+			s.q.cfg.OnError(err)
+		}
+
+		if s.q.wal == nil || !recoverable(err) {
+			s.q.logger.Warn("Dropped series of failed write", writeErrorAttr(err), "series", len(series), "samples", samples)
+			return true
+		}
+
+		s.q.logger.Warn("Retrying write of WAL series", writeErrorAttr(err), "attempt", attempt)
+
+		retry := RetryConfig{MinBackoff: s.q.cfg.WAL.MinBackoff, MaxBackoff: s.q.cfg.WAL.MaxBackoff}
+		timer := time.NewTimer(retry.backoff(attempt, 0))
+		select {
+		case <-s.q.sendCtx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *shard) nextBatch(all bool) ([]queuedSeries, int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.queued) == 0 || (!all && s.pendingSamples < s.q.cfg.MaxSamplesPerSend) {
+		return nil, 0
+	}
+
+	// A series with more samples than fit in a batch is still written on its own.
+	n, samples := 0, 0
+	for n < len(s.queued) {
+		c := s.queued[n].sampleCount()
+		if n > 0 && samples+c > s.q.cfg.MaxSamplesPerSend {
+			break
+		}
+		samples += c
+		n++
+	}
+
+	batch := make([]queuedSeries, n)
+	copy(batch, s.queued)
+	s.queued = s.queued[n:]
+	s.pendingSamples -= samples
+	s.q.cfg.Metrics.addQueued(-samples)
+
+	return batch, samples
+}
+
+// recoverable returns whether a write that failed with the error may succeed if retried.
+func recoverable(err WriteError) bool {
+	// A fan-out or sharded write is retried if it may succeed on any of the failed endpoints.
+	var me interface{ endpointErrors() []EndpointError }
+	if errors.As(err, &me) {
+		for _, e := range me.endpointErrors() {
+			if recoverable(e.Err) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var we writeError
+	if errors.As(err, &we) {
+		return we.recoverable
+	}
+
+	code := err.StatusCode()
+	return code == 0 || code/100 == 5 || code == http.StatusTooManyRequests
+}
+
+// labelsHash returns a hash of the label set, independent of the order of the labels.
+func labelsHash(labels []Label) uint64 {
+	if !sort.SliceIsSorted(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name }) {
+		sorted := make([]Label, len(labels))
+		copy(sorted, labels)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		labels = sorted
+	}
+
+	h := fnv.New64a()
+	for _, label := range labels {
+		h.Write([]byte(label.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(label.Value))
+		h.Write([]byte{0xff})
+	}
+
+	return h.Sum64()
+}
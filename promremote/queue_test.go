@@ -0,0 +1,384 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingClient is a Client that records the series lists it is asked to write.
+type recordingClient struct {
+	mtx     sync.Mutex
+	batches []TSList
+
+	// writeFn, if not nil, is called for every WriteTimeSeries call.
+	writeFn func(ctx context.Context, ts TSList) WriteError
+}
+
+func (c *recordingClient) WriteProto(context.Context, *prompb.WriteRequest, WriteOptions) (WriteResult, WriteError) {
+	return WriteResult{}, writeError{err: errors.New("not implemented")}
+}
+
+func (c *recordingClient) WriteTimeSeries(ctx context.Context, ts TSList, _ WriteOptions) (WriteResult, WriteError) {
+	if c.writeFn != nil {
+		if err := c.writeFn(ctx, ts); err != nil {
+			return WriteResult{StatusCode: err.StatusCode()}, err
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.batches = append(c.batches, ts)
+
+	return WriteResult{StatusCode: http.StatusOK}, nil
+}
+
+func (c *recordingClient) written() []TSList {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]TSList(nil), c.batches...)
+}
+
+func testSeries(name string, value float64) TimeSeries {
+	return TimeSeries{
+		Labels:    []Label{{Name: "__name__", Value: name}},
+		Datapoint: Datapoint{Timestamp: now, Value: value},
+	}
+}
+
+func TestQueueWriterBatchesByMaxSamples(t *testing.T) {
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:          100,
+		MaxSamplesPerSend: 3,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         1,
+	})
+	require.NoError(t, err)
+
+	multi := TimeSeries{
+		Labels: []Label{{Name: "__name__", Value: "multi"}},
+		Datapoints: []Datapoint{
+			{Timestamp: now, Value: 1},
+			{Timestamp: now.Add(time.Second), Value: 2},
+		},
+	}
+	require.NoError(t, q.Append(testSeries("a", 1), multi))
+	require.NoError(t, q.Append(testSeries("b", 2), testSeries("c", 3)))
+
+	// The first full batch is written without waiting for the deadline.
+	require.Eventually(t, func() bool { return len(c.written()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, TSList{testSeries("a", 1), multi}, c.written()[0])
+
+	require.NoError(t, q.Flush(context.Background()))
+	batches := c.written()
+	require.Len(t, batches, 2)
+	assert.Equal(t, TSList{testSeries("b", 2), testSeries("c", 3)}, batches[1])
+
+	require.NoError(t, q.Close(context.Background()))
+}
+
+func TestQueueWriterBatchSendDeadline(t *testing.T) {
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:          100,
+		MaxSamplesPerSend: 10,
+		BatchSendDeadline: 10 * time.Millisecond,
+		MinShards:         1,
+		MaxShards:         1,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1)))
+	require.Eventually(t, func() bool { return len(c.written()) == 1 }, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, q.Close(context.Background()))
+}
+
+func TestQueueWriterFull(t *testing.T) {
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:          2,
+		MaxSamplesPerSend: 2,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         1,
+	})
+	require.NoError(t, err)
+
+	// Hold the first write so that later appended series stay pending.
+	release := make(chan struct{})
+	c.writeFn = func(ctx context.Context, ts TSList) WriteError {
+		<-release
+		return nil
+	}
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	require.Eventually(t, func() bool { return q.shards[0].pending() == 0 }, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, q.Append(testSeries("c", 3)))
+	require.ErrorIs(t, q.Append(testSeries("d", 4), testSeries("e", 5)), ErrQueueFull)
+
+	close(release)
+	require.NoError(t, q.Close(context.Background()))
+
+	batches := c.written()
+	require.Len(t, batches, 2)
+	assert.Equal(t, TSList{testSeries("c", 3)}, batches[1])
+}
+
+func TestQueueWriterCloseDrains(t *testing.T) {
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, DefaultQueueConfig)
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	require.NoError(t, q.Close(context.Background()))
+
+	assert.Equal(t, []TSList{{testSeries("a", 1), testSeries("b", 2)}}, c.written())
+	require.ErrorIs(t, q.Append(testSeries("c", 3)), ErrQueueClosed)
+	require.ErrorIs(t, q.Flush(context.Background()), ErrQueueClosed)
+}
+
+func TestQueueWriterCloseTimeout(t *testing.T) {
+	c := &recordingClient{
+		writeFn: func(ctx context.Context, ts TSList) WriteError {
+			<-ctx.Done()
+			return writeError{err: ctx.Err()}
+		},
+	}
+
+	var errs []WriteError
+	cfg := DefaultQueueConfig
+	cfg.OnError = func(err WriteError) {
+		errs = append(errs, err)
+	}
+
+	q, err := NewQueueWriter(c, cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.Close(ctx), context.DeadlineExceeded)
+
+	assert.Empty(t, c.written())
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], context.Canceled)
+}
+
+func TestQueueWriterShardsBySeries(t *testing.T) {
+	c := &recordingClient{}
+	cfg := DefaultQueueConfig
+	cfg.MinShards = 4
+	cfg.MaxShards = 4
+	q, err := NewQueueWriter(c, cfg)
+	require.NoError(t, err)
+	require.Equal(t, 4, q.Shards())
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i := 0; i < 10; i++ {
+		for _, name := range names {
+			require.NoError(t, q.Append(testSeries(name, float64(i))))
+		}
+	}
+	require.NoError(t, q.Close(context.Background()))
+
+	// Every series went to a single shard, so its samples are written in order.
+	values := make(map[string][]float64)
+	for _, batch := range c.written() {
+		for _, ts := range batch {
+			name := ts.Labels[0].Value
+			values[name] = append(values[name], ts.Datapoint.Value)
+		}
+	}
+	require.Len(t, values, len(names))
+	for _, name := range names {
+		assert.Equal(t, []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, values[name], name)
+	}
+}
+
+func TestQueueWriterScalesShards(t *testing.T) {
+	c := &recordingClient{
+		writeFn: func(ctx context.Context, ts TSList) WriteError {
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+	}
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:            1000000,
+		MaxSamplesPerSend:   1,
+		BatchSendDeadline:   time.Millisecond,
+		MinShards:           1,
+		MaxShards:           8,
+		ShardUpdateInterval: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// Each write of a single sample takes at least a millisecond, so a single
+	// shard cannot keep up with appending 10 samples every millisecond.
+	stop := make(chan struct{})
+	appended := make(chan int)
+	go func() {
+		n := 0
+		defer func() { appended <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			for i := 0; i < 10; i++ {
+				require.NoError(t, q.Append(testSeries("series", float64(n))))
+				n++
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool { return q.Shards() > 1 }, 5*time.Second, time.Millisecond)
+	close(stop)
+	n := <-appended
+	require.NoError(t, q.Close(context.Background()))
+
+	// Resharding kept the samples of the series in order.
+	var values []float64
+	for _, batch := range c.written() {
+		for _, ts := range batch {
+			values = append(values, ts.Datapoint.Value)
+		}
+	}
+	require.Len(t, values, n)
+	for i, v := range values {
+		require.Equal(t, float64(i), v)
+	}
+}
+
+func TestDesiredShards(t *testing.T) {
+	tests := []struct {
+		name     string
+		stats    shardStats
+		expected int
+	}{
+		{
+			name:     "no writes",
+			stats:    shardStats{current: 3, samplesIn: 1000, interval: time.Second},
+			expected: 3,
+		},
+		{
+			name: "scale up",
+			// 10ms per sample and 1000 samples/s need 10 shards.
+			stats:    shardStats{current: 2, samplesIn: 1000, samplesOut: 100, sendTime: time.Second, interval: time.Second},
+			expected: 10,
+		},
+		{
+			name: "scale up for backlog",
+			stats: shardStats{
+				current: 2, samplesIn: 500, samplesOut: 100, sendTime: time.Second, pending: 500, interval: time.Second,
+			},
+			expected: 10,
+		},
+		{
+			name:     "within tolerance",
+			stats:    shardStats{current: 9, samplesIn: 1000, samplesOut: 100, sendTime: time.Second, interval: time.Second},
+			expected: 9,
+		},
+		{
+			name:     "scale down to min",
+			stats:    shardStats{current: 10, samplesIn: 10, samplesOut: 100, sendTime: time.Second, interval: time.Second},
+			expected: 2,
+		},
+		{
+			name:     "scale up to max",
+			stats:    shardStats{current: 10, samplesIn: 100000, samplesOut: 100, sendTime: time.Second, interval: time.Second},
+			expected: 50,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, desiredShards(test.stats, 2, 50), test.name)
+	}
+}
+
+func TestLabelsHash(t *testing.T) {
+	a := []Label{{Name: "__name__", Value: "foo"}, {Name: "job", Value: "api"}}
+	b := []Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "foo"}}
+	c := []Label{{Name: "__name__", Value: "foo"}, {Name: "job", Value: "web"}}
+
+	assert.Equal(t, labelsHash(a), labelsHash(b))
+	assert.NotEqual(t, labelsHash(a), labelsHash(c))
+	assert.Equal(t, "job", b[0].Name, "labels are not sorted in place")
+}
+
+func TestValidateQueueConfig(t *testing.T) {
+	tests := []QueueConfig{
+		{Capacity: 10, MaxSamplesPerSend: 0, BatchSendDeadline: time.Second, MinShards: 1, MaxShards: 1},
+		{Capacity: 1, MaxSamplesPerSend: 10, BatchSendDeadline: time.Second, MinShards: 1, MaxShards: 1},
+		{Capacity: 10, MaxSamplesPerSend: 10, BatchSendDeadline: 0, MinShards: 1, MaxShards: 1},
+		{Capacity: 10, MaxSamplesPerSend: 10, BatchSendDeadline: time.Second, MinShards: 0, MaxShards: 1},
+		{Capacity: 10, MaxSamplesPerSend: 10, BatchSendDeadline: time.Second, MinShards: 2, MaxShards: 1},
+		{Capacity: 10, MaxSamplesPerSend: 10, BatchSendDeadline: time.Second, MinShards: 1, MaxShards: 2},
+	}
+
+	for _, cfg := range tests {
+		_, err := NewQueueWriter(&recordingClient{}, cfg)
+		require.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestQueueWriterOversizedSeries(t *testing.T) {
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, QueueConfig{
+		Capacity:          2,
+		MaxSamplesPerSend: 2,
+		BatchSendDeadline: time.Hour,
+		MinShards:         1,
+		MaxShards:         1,
+	})
+	require.NoError(t, err)
+
+	oversized := TimeSeries{
+		Labels: []Label{{Name: "__name__", Value: "oversized"}},
+		Datapoints: []Datapoint{
+			{Timestamp: now, Value: 1},
+			{Timestamp: now.Add(time.Second), Value: 2},
+			{Timestamp: now.Add(2 * time.Second), Value: 3},
+		},
+	}
+
+	// The series is queued in the empty shard, but not next to others.
+	require.ErrorIs(t, q.Append(oversized, testSeries("a", 1)), ErrQueueFull)
+	require.NoError(t, q.Append(oversized))
+
+	require.NoError(t, q.Close(context.Background()))
+	assert.Equal(t, []TSList{{oversized}}, c.written())
+}
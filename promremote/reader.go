@@ -0,0 +1,423 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+const (
+	remoteReadVersion        = "0.1.0"
+	streamedChunksMediaType  = "application/x-streamed-protobuf"
+	maxChunkedReadFrameBytes = 50 * 1024 * 1024
+)
+
+var readCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Query selects the series matching all matchers that have samples between start and end.
+type Query struct {
+	Matchers []*prompb.LabelMatcher
+	Start    time.Time
+	End      time.Time
+
+	// Hints, if not nil, are passed on to the remote read endpoint.
+	Hints *prompb.ReadHints
+}
+
+// ReadOptions specifies additional read options.
+type ReadOptions struct {
+	// Headers to append or override the outgoing headers.
+	Headers map[string]string
+}
+
+// ReadError is an error that can also return the HTTP status code
+// if the response is what caused an error.
+type ReadError interface {
+	error
+	StatusCode() int
+}
+
+// Reader is used to read timeseries data from a Prom remote read endpoint
+// such as the one in m3coordinator.
+type Reader interface {
+	// ReadProto sends the Prom proto ReadRequest to the specified endpoint and returns
+	// one result per query. Streamed chunked responses are decoded into samples.
+	ReadProto(
+		ctx context.Context,
+		req *prompb.ReadRequest,
+		opts ReadOptions,
+	) (*prompb.ReadResponse, ReadError)
+
+	// Read runs the query against the specified endpoint and returns the matching series
+	// with all their datapoints in Datapoints and Histograms.
+	Read(
+		ctx context.Context,
+		query Query,
+		opts ReadOptions,
+	) (TSList, ReadError)
+}
+
+type reader struct {
+	readURL    string
+	httpClient *http.Client
+	userAgent  string
+}
+
+// NewReader creates a new remote read coordinator reader.
+func NewReader(c Config) (Reader, error) {
+	if err := c.validateRead(); err != nil {
+		return nil, err
+	}
+
+	httpClient, err := c.newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		readURL:    c.ReadURL,
+		httpClient: httpClient,
+		userAgent:  c.UserAgent,
+	}, nil
+}
+
+func (c Config) validateRead() error {
+	if c.HTTPClientTimeout <= 0 {
+		return fmt.Errorf("http client timeout should be greater than 0: %d", c.HTTPClientTimeout)
+	}
+
+	if c.ReadURL == "" {
+		return errors.New("remote read URL should not be blank")
+	}
+
+	if c.UserAgent == "" {
+		return errors.New("User-Agent should not be blank")
+	}
+
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+
+	return c.validateTLS()
+}
+
+func (r *reader) Read(
+	ctx context.Context,
+	query Query,
+	opts ReadOptions,
+) (TSList, ReadError) {
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{{
+			StartTimestampMs: toMillis(query.Start),
+			EndTimestampMs:   toMillis(query.End),
+			Matchers:         query.Matchers,
+			Hints:            query.Hints,
+		}},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{
+			prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+			prompb.ReadRequest_SAMPLES,
+		},
+	}
+
+	resp, err := r.ReadProto(ctx, req, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var tsList TSList
+	for _, ts := range resp.Results[0].Timeseries {
+		tsList = append(tsList, fromPromTimeSeries(ts))
+	}
+
+	return tsList, nil
+}
+
+func (r *reader) ReadProto(
+	ctx context.Context,
+	promRR *prompb.ReadRequest,
+	opts ReadOptions,
+) (*prompb.ReadResponse, ReadError) {
+	data, err := proto.Marshal(promRR)
+	if err != nil {
+		return nil, writeError{err: fmt.Errorf("unable to marshal protobuf: %v", err)}
+	}
+
+	req, err := http.NewRequest("POST", r.readURL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, writeError{err: err}
+	}
+
+	req.Header.Set("Content-Type", appProtoContentType)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Accept-Encoding", "snappy")
+	req.Header.Set("User-Agent", r.userAgent)
+	req.Header.Set("X-Prometheus-Remote-Read-Version", remoteReadVersion)
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := r.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, writeError{err: err}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, writeError{
+			err:  fmt.Errorf("expected HTTP 200 status code: actual=%d, body=%s", resp.StatusCode, body),
+			code: resp.StatusCode,
+		}
+	}
+
+	var promResp *prompb.ReadResponse
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), streamedChunksMediaType) {
+		promResp, err = decodeChunkedReadResponse(resp.Body, len(promRR.Queries))
+	} else {
+		promResp, err = decodeSampledReadResponse(resp.Body)
+	}
+	if err != nil {
+		return nil, writeError{err: err, code: resp.StatusCode}
+	}
+
+	if len(promResp.Results) != len(promRR.Queries) {
+		return nil, writeError{
+			err:  fmt.Errorf("expected %d query results: actual=%d", len(promRR.Queries), len(promResp.Results)),
+			code: resp.StatusCode,
+		}
+	}
+
+	return promResp, nil
+}
+
+// decodeSampledReadResponse decodes a snappy-compressed ReadResponse.
+func decodeSampledReadResponse(body io.Reader) (*prompb.ReadResponse, error) {
+	compressed, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %v", err)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode snappy response: %v", err)
+	}
+
+	var resp prompb.ReadResponse
+	if err := proto.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal protobuf: %v", err)
+	}
+
+	return &resp, nil
+}
+
+// decodeChunkedReadResponse decodes a stream of ChunkedReadResponse frames,
+// each made of a uvarint length, a CRC32 Castagnoli checksum and the message,
+// into one sampled result per query.
+func decodeChunkedReadResponse(body io.Reader, queries int) (*prompb.ReadResponse, error) {
+	// A series whose chunks exceed the frame size is split over several frames,
+	// as consecutive chunked series with the same labels, so the chunks of each
+	// series are gathered before being decoded.
+	chunkedSeries := make([][]*prompb.ChunkedSeries, queries)
+
+	br := bufio.NewReader(body)
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read chunked frame: %v", err)
+		}
+		if size > maxChunkedReadFrameBytes {
+			return nil, fmt.Errorf("chunked frame exceeds %d bytes: %d", maxChunkedReadFrameBytes, size)
+		}
+
+		var checksum uint32
+		if err := binary.Read(br, binary.BigEndian, &checksum); err != nil {
+			return nil, fmt.Errorf("unable to read chunked frame: %v", err)
+		}
+
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return nil, fmt.Errorf("unable to read chunked frame: %v", err)
+		}
+		if crc32.Checksum(frame, readCastagnoli) != checksum {
+			return nil, errors.New("chunked frame checksum mismatch")
+		}
+
+		var chunked prompb.ChunkedReadResponse
+		if err := proto.Unmarshal(frame, &chunked); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal protobuf: %v", err)
+		}
+		if chunked.QueryIndex < 0 || chunked.QueryIndex >= int64(queries) {
+			return nil, fmt.Errorf("chunked frame for unknown query: %d", chunked.QueryIndex)
+		}
+
+		merged := chunkedSeries[chunked.QueryIndex]
+		for _, series := range chunked.ChunkedSeries {
+			if n := len(merged); n > 0 && labelsEqual(merged[n-1].Labels, series.Labels) {
+				merged[n-1].Chunks = append(merged[n-1].Chunks, series.Chunks...)
+				continue
+			}
+			merged = append(merged, series)
+		}
+		chunkedSeries[chunked.QueryIndex] = merged
+	}
+
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, queries)}
+	for i, merged := range chunkedSeries {
+		resp.Results[i] = &prompb.QueryResult{}
+		for _, series := range merged {
+			ts, err := decodeChunkedSeries(series)
+			if err != nil {
+				return nil, err
+			}
+			resp.Results[i].Timeseries = append(resp.Results[i].Timeseries, ts)
+		}
+	}
+
+	return resp, nil
+}
+
+func labelsEqual(a, b []prompb.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeChunkedSeries decodes the chunks of a series into samples and histograms.
+// Chunks may overlap, in which case the first sample of each timestamp is kept.
+func decodeChunkedSeries(series *prompb.ChunkedSeries) (*prompb.TimeSeries, error) {
+	ts := &prompb.TimeSeries{Labels: series.Labels}
+
+	for _, chk := range series.Chunks {
+		// The proto chunk encodings share the values of the TSDB ones.
+		c, err := chunkenc.FromData(chunkenc.Encoding(chk.Type), chk.Data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode chunk: %v", err)
+		}
+
+		it := c.Iterator(nil)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			switch vt {
+			case chunkenc.ValFloat:
+				t, v := it.At()
+				ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: v})
+			case chunkenc.ValHistogram:
+				t, h := it.AtHistogram(nil)
+				ts.Histograms = append(ts.Histograms, prompb.FromIntHistogram(t, h))
+			case chunkenc.ValFloatHistogram:
+				t, h := it.AtFloatHistogram(nil)
+				ts.Histograms = append(ts.Histograms, prompb.FromFloatHistogram(t, h))
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, fmt.Errorf("unable to iterate chunk: %v", err)
+		}
+	}
+
+	sort.SliceStable(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+	sort.SliceStable(ts.Histograms, func(i, j int) bool { return ts.Histograms[i].Timestamp < ts.Histograms[j].Timestamp })
+	ts.Samples = dedupeSamples(ts.Samples)
+	ts.Histograms = dedupeHistograms(ts.Histograms)
+
+	return ts, nil
+}
+
+func dedupeSamples(samples []prompb.Sample) []prompb.Sample {
+	if len(samples) == 0 {
+		return samples
+	}
+
+	deduped := samples[:1]
+	for _, s := range samples[1:] {
+		if s.Timestamp != deduped[len(deduped)-1].Timestamp {
+			deduped = append(deduped, s)
+		}
+	}
+
+	return deduped
+}
+
+func dedupeHistograms(histograms []prompb.Histogram) []prompb.Histogram {
+	if len(histograms) == 0 {
+		return histograms
+	}
+
+	deduped := histograms[:1]
+	for _, h := range histograms[1:] {
+		if h.Timestamp != deduped[len(deduped)-1].Timestamp {
+			deduped = append(deduped, h)
+		}
+	}
+
+	return deduped
+}
+
+// fromPromTimeSeries converts a Prometheus proto series to a TimeSeries
+// holding all its samples in Datapoints.
+func fromPromTimeSeries(ts *prompb.TimeSeries) TimeSeries {
+	series := TimeSeries{Labels: fromPromLabels(ts.Labels)}
+
+	for _, s := range ts.Samples {
+		series.Datapoints = append(series.Datapoints, Datapoint{
+			Timestamp: time.UnixMilli(s.Timestamp),
+			Value:     s.Value,
+		})
+	}
+
+	for _, h := range ts.Histograms {
+		hdp := HistogramDatapoint{Timestamp: time.UnixMilli(h.Timestamp)}
+		if h.IsFloatHistogram() {
+			hdp.FloatHistogram = h.ToFloatHistogram()
+		} else {
+			hdp.Histogram = h.ToIntHistogram()
+		}
+		series.Histograms = append(series.Histograms, hdp)
+	}
+
+	return series
+}
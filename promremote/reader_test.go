@@ -0,0 +1,245 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReader(t *testing.T, url string) Reader {
+	cfg := NewConfig(
+		ReadURLOption(url),
+		UserAgent("test-reader"),
+	)
+
+	r, err := NewReader(cfg)
+	require.NoError(t, err)
+
+	return r
+}
+
+func decodeReadRequest(t *testing.T, r *http.Request) *prompb.ReadRequest {
+	defer r.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+
+	decoded, err := snappy.Decode(nil, bodyBytes)
+	require.NoError(t, err)
+
+	var req prompb.ReadRequest
+	require.NoError(t, proto.Unmarshal(decoded, &req))
+
+	return &req
+}
+
+func testQuery() Query {
+	return Query{
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "foo_bar"},
+		},
+		Start: now.Add(-time.Minute),
+		End:   now,
+	}
+}
+
+func TestReaderReadSamples(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Read-Version"))
+		assert.Equal(t, "test-reader", r.Header.Get("User-Agent"))
+
+		req := decodeReadRequest(t, r)
+		require.Len(t, req.Queries, 1)
+		assert.Equal(t, nowMillis, req.Queries[0].EndTimestampMs)
+		assert.Equal(t, nowMillis-60000, req.Queries[0].StartTimestampMs)
+		assert.Equal(t, "foo_bar", req.Queries[0].Matchers[0].Value)
+		assert.Equal(t, []prompb.ReadRequest_ResponseType{
+			prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+			prompb.ReadRequest_SAMPLES,
+		}, req.AcceptedResponseTypes)
+
+		resp := &prompb.ReadResponse{Results: []*prompb.QueryResult{{
+			Timeseries: []*prompb.TimeSeries{{
+				Labels: []prompb.Label{{Name: "__name__", Value: "foo_bar"}},
+				Samples: []prompb.Sample{
+					{Timestamp: nowMillis - 1000, Value: 1},
+					{Timestamp: nowMillis, Value: 2},
+				},
+			}},
+		}}}
+		data, err := proto.Marshal(resp)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, err = w.Write(snappy.Encode(nil, data))
+		require.NoError(t, err)
+	}))
+	defer testServer.Close()
+
+	tsList, err := newTestReader(t, testServer.URL).Read(context.Background(), testQuery(), ReadOptions{})
+	require.Nil(t, err)
+	require.Len(t, tsList, 1)
+
+	assert.Equal(t, []Label{{Name: "__name__", Value: "foo_bar"}}, tsList[0].Labels)
+	assert.Equal(t, []Datapoint{
+		{Timestamp: time.UnixMilli(nowMillis - 1000), Value: 1},
+		{Timestamp: time.UnixMilli(nowMillis), Value: 2},
+	}, tsList[0].Datapoints)
+}
+
+func writeChunkedFrame(t *testing.T, w http.ResponseWriter, msg *prompb.ChunkedReadResponse) {
+	data, err := proto.Marshal(msg)
+	require.NoError(t, err)
+
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+
+	_, err = w.Write(header[:n+4])
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+}
+
+func xorChunk(t *testing.T, samples ...prompb.Sample) prompb.Chunk {
+	c := chunkenc.NewXORChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+
+	for _, s := range samples {
+		app.Append(s.Timestamp, s.Value)
+	}
+
+	return prompb.Chunk{
+		MinTimeMs: samples[0].Timestamp,
+		MaxTimeMs: samples[len(samples)-1].Timestamp,
+		Type:      prompb.Chunk_XOR,
+		Data:      c.Bytes(),
+	}
+}
+
+func TestReaderReadStreamedChunks(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decodeReadRequest(t, r)
+
+		w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		writeChunkedFrame(t, w, &prompb.ChunkedReadResponse{
+			ChunkedSeries: []*prompb.ChunkedSeries{{
+				Labels: []prompb.Label{{Name: "__name__", Value: "foo_bar"}},
+				Chunks: []prompb.Chunk{
+					xorChunk(t,
+						prompb.Sample{Timestamp: nowMillis - 2000, Value: 1},
+						prompb.Sample{Timestamp: nowMillis - 1000, Value: 2},
+					),
+					// Overlapping chunks keep the first sample of each timestamp.
+					xorChunk(t,
+						prompb.Sample{Timestamp: nowMillis - 1000, Value: 2},
+						prompb.Sample{Timestamp: nowMillis, Value: 3},
+					),
+				},
+			}},
+		})
+		writeChunkedFrame(t, w, &prompb.ChunkedReadResponse{
+			ChunkedSeries: []*prompb.ChunkedSeries{
+				{
+					Labels: []prompb.Label{{Name: "__name__", Value: "foo_baz"}},
+					Chunks: []prompb.Chunk{
+						xorChunk(t, prompb.Sample{Timestamp: nowMillis - 3000, Value: 4}),
+					},
+				},
+			},
+		})
+		// The rest of foo_baz is split over a further frame.
+		writeChunkedFrame(t, w, &prompb.ChunkedReadResponse{
+			ChunkedSeries: []*prompb.ChunkedSeries{{
+				Labels: []prompb.Label{{Name: "__name__", Value: "foo_baz"}},
+				Chunks: []prompb.Chunk{
+					xorChunk(t,
+						prompb.Sample{Timestamp: nowMillis - 3000, Value: 4},
+						prompb.Sample{Timestamp: nowMillis, Value: 5},
+					),
+				},
+			}},
+		})
+	}))
+	defer testServer.Close()
+
+	tsList, err := newTestReader(t, testServer.URL).Read(context.Background(), testQuery(), ReadOptions{})
+	require.Nil(t, err)
+	require.Len(t, tsList, 2)
+
+	assert.Equal(t, []Datapoint{
+		{Timestamp: time.UnixMilli(nowMillis - 2000), Value: 1},
+		{Timestamp: time.UnixMilli(nowMillis - 1000), Value: 2},
+		{Timestamp: time.UnixMilli(nowMillis), Value: 3},
+	}, tsList[0].Datapoints)
+	assert.Equal(t, "foo_baz", tsList[1].Labels[0].Value)
+	assert.Equal(t, []Datapoint{
+		{Timestamp: time.UnixMilli(nowMillis - 3000), Value: 4},
+		{Timestamp: time.UnixMilli(nowMillis), Value: 5},
+	}, tsList[1].Datapoints)
+}
+
+func TestReaderReadChecksumMismatch(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		_, err := w.Write([]byte{2, 0, 0, 0, 0, 1, 2})
+		require.NoError(t, err)
+	}))
+	defer testServer.Close()
+
+	_, err := newTestReader(t, testServer.URL).Read(context.Background(), testQuery(), ReadOptions{})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestReaderReadNotHTTPOK(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	_, err := newTestReader(t, testServer.URL).Read(context.Background(), testQuery(), ReadOptions{})
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, err.StatusCode())
+}
+
+func TestValidateConfigRead(t *testing.T) {
+	cfg := NewConfig(ReadURLOption(""))
+	_, err := NewReader(cfg)
+	require.Error(t, err)
+}
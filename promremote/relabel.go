@@ -0,0 +1,156 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func validateRelabelConfigs(cfgs []*relabel.Config) error {
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			return fmt.Errorf("write relabel config %d should not be nil", i)
+		}
+		if cfg.Regex.Regexp == nil {
+			return fmt.Errorf("write relabel config %d has no regex, start from relabel.DefaultRelabelConfig", i)
+		}
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid write relabel config %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// labelProcessor adds the external labels to the labels of written series, then
+// applies the write relabel configs to them.
+type labelProcessor struct {
+	externalLabels []Label
+	relabelConfigs []*relabel.Config
+}
+
+func (p labelProcessor) enabled() bool {
+	return len(p.externalLabels) > 0 || len(p.relabelConfigs) > 0
+}
+
+// process returns the processed labels of a series, or false if the series is
+// dropped by relabeling or left without labels, as Prometheus does.
+func (p labelProcessor) process(ls []Label) ([]Label, bool) {
+	ls = withExternalLabels(ls, p.externalLabels)
+	if len(p.relabelConfigs) == 0 {
+		return ls, true
+	}
+
+	builder := labels.NewScratchBuilder(len(ls))
+	for _, l := range ls {
+		builder.Add(l.Name, l.Value)
+	}
+	builder.Sort()
+
+	relabeled, keep := relabel.Process(builder.Labels(), p.relabelConfigs...)
+	if !keep || relabeled.IsEmpty() {
+		return nil, false
+	}
+
+	processed := make([]Label, 0, relabeled.Len())
+	relabeled.Range(func(l labels.Label) {
+		processed = append(processed, Label{Name: l.Name, Value: l.Value})
+	})
+
+	return processed, true
+}
+
+// processPromWriteRequest returns a copy of the request with the labels of its
+// series processed, leaving out dropped series.
+func (p labelProcessor) processPromWriteRequest(req *prompb.WriteRequest) *prompb.WriteRequest {
+	if !p.enabled() {
+		return req
+	}
+
+	processed := *req
+	processed.Timeseries = make([]prompb.TimeSeries, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		ls, keep := p.process(fromPromLabels(ts.Labels))
+		if !keep {
+			continue
+		}
+		ts.Labels = toPromLabels(ls)
+		processed.Timeseries = append(processed.Timeseries, ts)
+	}
+
+	return &processed
+}
+
+// processWriteV2Request returns a copy of the request with the labels of its
+// series processed, leaving out dropped series. New label names and values are
+// appended to the symbol table.
+func (p labelProcessor) processWriteV2Request(req *writev2.Request) *writev2.Request {
+	if !p.enabled() {
+		return req
+	}
+
+	processed := *req
+	processed.Symbols = append([]string(nil), req.Symbols...)
+	refs := make(map[string]uint32, len(processed.Symbols))
+	for i, s := range processed.Symbols {
+		if _, ok := refs[s]; !ok {
+			refs[s] = uint32(i)
+		}
+	}
+	symbolize := func(s string) uint32 {
+		if ref, ok := refs[s]; ok {
+			return ref
+		}
+		ref := uint32(len(processed.Symbols))
+		processed.Symbols = append(processed.Symbols, s)
+		refs[s] = ref
+		return ref
+	}
+
+	processed.Timeseries = make([]writev2.TimeSeries, 0, len(req.Timeseries))
+	for _, ts := range req.Timeseries {
+		ls, keep := p.process(fromPromLabels(desymbolizeLabels(ts.LabelsRefs, req.Symbols)))
+		if !keep {
+			continue
+		}
+		ts.LabelsRefs = make([]uint32, 0, 2*len(ls))
+		for _, l := range ls {
+			ts.LabelsRefs = append(ts.LabelsRefs, symbolize(l.Name), symbolize(l.Value))
+		}
+		processed.Timeseries = append(processed.Timeseries, ts)
+	}
+
+	return &processed
+}
+
+func toPromLabels(ls []Label) []prompb.Label {
+	promLabels := make([]prompb.Label, len(ls))
+	for i, l := range ls {
+		promLabels[i] = prompb.Label{Name: l.Name, Value: l.Value}
+	}
+
+	return promLabels
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestClientWriteRelabelConfigsFromYAML(t *testing.T) {
+	var req *prompb.WriteRequest
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = decodeWriteRequest(t, r)
+	}))
+	defer testServer.Close()
+
+	cfg := NewConfig(WriteURLOption(testServer.URL))
+	require.NoError(t, yaml.Unmarshal([]byte(`
+externalLabels:
+  tenant: team-a
+writeRelabelConfigs:
+  - source_labels: [__name__]
+    regex: debug_.*
+    action: drop
+  - source_labels: [tenant]
+    target_label: tenant
+    replacement: prod-$1
+  - regex: pod_uid
+    action: labeldrop
+`), &cfg))
+
+	c, err := NewClient(cfg)
+	require.NoError(t, err)
+
+	tsList := TSList{
+		{
+			Labels:    []Label{{Name: "__name__", Value: "debug_requests"}, {Name: "pod_uid", Value: "1234"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 1},
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "pod_uid", Value: "1234"}},
+			Datapoint: Datapoint{Timestamp: now, Value: 2},
+		},
+	}
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "tenant", Value: "prod-team-a"},
+	}, req.Timeseries[0].Labels)
+	assert.Equal(t, 2.0, req.Timeseries[0].Samples[0].Value)
+
+	// Series dropped by relabeling are left out of raw requests as well.
+	_, writeErr = c.WriteProto(context.Background(), &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "debug_requests"}}, Samples: []prompb.Sample{{Value: 1}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1}}},
+	}}, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "tenant", Value: "prod-team-a"},
+	}, req.Timeseries[0].Labels)
+}
+
+func TestClientWriteRelabelDropsAllSeries(t *testing.T) {
+	var requests int
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer testServer.Close()
+
+	drop := relabel.DefaultRelabelConfig
+	drop.Action = relabel.Drop
+	drop.SourceLabels = []model.LabelName{"__name__"}
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteRelabelConfigsOption(&drop),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, 0, requests)
+
+	_, writeErr = c.WriteProto(context.Background(), &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1}}},
+	}}, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, 0, requests)
+
+	symbols := writev2.NewSymbolTable()
+	_, writeErr = c.(V2Writer).WriteProtoV2(context.Background(), &writev2.Request{
+		Timeseries: []writev2.TimeSeries{{
+			LabelsRefs: symbols.SymbolizeLabels(labels.FromStrings("__name__", "up"), nil),
+			Samples:    []writev2.Sample{{Value: 1}},
+		}},
+		Symbols: symbols.Symbols(),
+	}, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, 0, requests)
+}
+
+func TestLabelProcessorActions(t *testing.T) {
+	series := []Label{
+		{Name: "__meta_pod", Value: "api-0"},
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "env", Value: "PROD"},
+		{Name: "job", Value: "api"},
+	}
+
+	tests := []struct {
+		name     string
+		yaml     string
+		expected []Label
+		dropped  bool
+	}{
+		{
+			name:     "keep",
+			yaml:     `{source_labels: [job], regex: api, action: keep}`,
+			expected: series,
+		},
+		{
+			name:    "keep drops",
+			yaml:    `{source_labels: [job], regex: web, action: keep}`,
+			dropped: true,
+		},
+		{
+			name: "labelmap",
+			yaml: `{regex: __meta_(.+), action: labelmap}`,
+			expected: []Label{
+				{Name: "__meta_pod", Value: "api-0"},
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "env", Value: "PROD"},
+				{Name: "job", Value: "api"},
+				{Name: "pod", Value: "api-0"},
+			},
+		},
+		{
+			name: "labelkeep",
+			yaml: `{regex: __name__|job, action: labelkeep}`,
+			expected: []Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "job", Value: "api"},
+			},
+		},
+		{
+			name:    "labelkeep drops empty series",
+			yaml:    `{regex: instance, action: labelkeep}`,
+			dropped: true,
+		},
+		{
+			name: "hashmod",
+			yaml: `{source_labels: [job], modulus: 1, target_label: shard, action: hashmod}`,
+			expected: []Label{
+				{Name: "__meta_pod", Value: "api-0"},
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "env", Value: "PROD"},
+				{Name: "job", Value: "api"},
+				{Name: "shard", Value: "0"},
+			},
+		},
+		{
+			name: "lowercase",
+			yaml: `{source_labels: [env], target_label: env, action: lowercase}`,
+			expected: []Label{
+				{Name: "__meta_pod", Value: "api-0"},
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "env", Value: "prod"},
+				{Name: "job", Value: "api"},
+			},
+		},
+		{
+			name: "uppercase",
+			yaml: `{source_labels: [job], target_label: team, action: uppercase}`,
+			expected: []Label{
+				{Name: "__meta_pod", Value: "api-0"},
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "env", Value: "PROD"},
+				{Name: "job", Value: "api"},
+				{Name: "team", Value: "API"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cfg relabel.Config
+			require.NoError(t, yaml.Unmarshal([]byte(test.yaml), &cfg))
+			require.NoError(t, validateRelabelConfigs([]*relabel.Config{&cfg}))
+
+			processed, keep := labelProcessor{relabelConfigs: []*relabel.Config{&cfg}}.process(series)
+			assert.Equal(t, !test.dropped, keep)
+			assert.Equal(t, test.expected, processed)
+		})
+	}
+}
+
+func TestValidateConfigWriteRelabelConfigs(t *testing.T) {
+	hashmod := relabel.DefaultRelabelConfig
+	hashmod.Action = relabel.HashMod
+	hashmod.TargetLabel = "shard"
+
+	tests := [][]*relabel.Config{
+		{nil},
+		{{Action: relabel.Drop}},
+		{&hashmod},
+	}
+
+	for _, cfgs := range tests {
+		_, err := NewClient(NewConfig(WriteRelabelConfigsOption(cfgs...)))
+		require.Error(t, err)
+	}
+}
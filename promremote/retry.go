@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryConfig is the default retry configuration, which does not retry.
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 1,
+	MinBackoff:  30 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+}
+
+// RetryConfig configures how failed writes are retried. Network errors and
+// 5xx responses are retried, 429 responses only if RetryOnRateLimit is set,
+// and other 4xx responses never are.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts per write, including the
+	// first one. If zero, writes are attempted once.
+	MaxAttempts int `yaml:"maxAttempts"`
+
+	// MinBackoff is the delay before the first retry, doubled on every following retry.
+	MinBackoff time.Duration `yaml:"minBackoff"`
+
+	// MaxBackoff is the maximum delay between retries, including delays
+	// requested through Retry-After.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+
+	// Jitter is the fraction, between 0 and 1, by which backoffs are randomly shortened or lengthened.
+	Jitter float64 `yaml:"jitter"`
+
+	// RetryOnRateLimit enables retrying 429 Too Many Requests responses.
+	RetryOnRateLimit bool `yaml:"retryOnRateLimit"`
+}
+
+func (r RetryConfig) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("retry max attempts should not be negative: %d", r.MaxAttempts)
+	}
+
+	if r.MaxAttempts <= 1 {
+		return nil
+	}
+
+	if r.MinBackoff <= 0 {
+		return fmt.Errorf("retry min backoff should be greater than 0: %d", r.MinBackoff)
+	}
+
+	if r.MaxBackoff < r.MinBackoff {
+		return errors.New("retry max backoff should not be less than min backoff")
+	}
+
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("retry jitter should be between 0 and 1: %v", r.Jitter)
+	}
+
+	return nil
+}
+
+func (r RetryConfig) retryableStatus(code int) bool {
+	return code/100 == 5 || (code == http.StatusTooManyRequests && r.RetryOnRateLimit)
+}
+
+// backoff returns the delay before the given retry attempt. A delay requested
+// by the endpoint through Retry-After takes precedence over the computed one,
+// up to MaxBackoff.
+func (r RetryConfig) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, r.MaxBackoff)
+	}
+
+	backoff := r.MinBackoff
+	for i := 1; i < attempt && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	if r.Jitter > 0 {
+		backoff += time.Duration(r.Jitter * (2*rand.Float64() - 1) * float64(backoff))
+	}
+
+	return min(backoff, r.MaxBackoff)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
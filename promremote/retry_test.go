@@ -0,0 +1,282 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var retryTestTSList = TSList{{
+	Labels:    []Label{{Name: "__name__", Value: "foo_bar"}},
+	Datapoint: Datapoint{Timestamp: now, Value: 1415.92},
+}}
+
+func newRetryTestClient(t *testing.T, url string, retry RetryConfig) Client {
+	c, err := NewClient(NewConfig(
+		WriteURLOption(url),
+		RetryOption(retry),
+	))
+	require.NoError(t, err)
+
+	return c
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer testServer.Close()
+
+	c := newRetryTestClient(t, testServer.URL, RetryConfig{
+		MaxAttempts: 3,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+		Jitter:      0.5,
+	})
+
+	r, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, int32(3), attempts.Load())
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	defer testServer.Close()
+
+	c := newRetryTestClient(t, testServer.URL, RetryConfig{
+		MaxAttempts: 4,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	})
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, http.StatusBadGateway, writeErr.StatusCode())
+	assert.Equal(t, int32(4), attempts.Load())
+}
+
+func TestRetryClientErrors(t *testing.T) {
+	tests := []struct {
+		name             string
+		code             int
+		retryOnRateLimit bool
+		expectedAttempts int32
+	}{
+		{name: "bad request", code: http.StatusBadRequest, retryOnRateLimit: true, expectedAttempts: 1},
+		{name: "rate limited", code: http.StatusTooManyRequests, expectedAttempts: 1},
+		{name: "rate limited with retries", code: http.StatusTooManyRequests, retryOnRateLimit: true, expectedAttempts: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				w.WriteHeader(test.code)
+			}))
+
+			defer testServer.Close()
+
+			c := newRetryTestClient(t, testServer.URL, RetryConfig{
+				MaxAttempts:      3,
+				MinBackoff:       time.Millisecond,
+				MaxBackoff:       time.Millisecond,
+				RetryOnRateLimit: test.retryOnRateLimit,
+			})
+
+			_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+			require.Error(t, writeErr)
+			assert.Equal(t, test.code, writeErr.StatusCode())
+			assert.Equal(t, test.expectedAttempts, attempts.Load())
+		})
+	}
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		}
+	}))
+
+	defer testServer.Close()
+
+	c := newRetryTestClient(t, testServer.URL, RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+	})
+
+	r, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, int32(2), attempts.Load())
+}
+
+func TestRetryStopsOnContextDone(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer testServer.Close()
+
+	c := newRetryTestClient(t, testServer.URL, RetryConfig{
+		MaxAttempts: 5,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  time.Hour,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, writeErr := c.WriteTimeSeries(ctx, retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, http.StatusServiceUnavailable, writeErr.StatusCode())
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestRetryBackoff(t *testing.T) {
+	retry := RetryConfig{
+		MaxAttempts: 10,
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  time.Second,
+	}
+
+	assert.Equal(t, 100*time.Millisecond, retry.backoff(1, 0))
+	assert.Equal(t, 200*time.Millisecond, retry.backoff(2, 0))
+	assert.Equal(t, 800*time.Millisecond, retry.backoff(4, 0))
+	assert.Equal(t, time.Second, retry.backoff(5, 0))
+	assert.Equal(t, time.Second, retry.backoff(100, 0))
+	assert.Equal(t, 700*time.Millisecond, retry.backoff(1, 700*time.Millisecond))
+	assert.Equal(t, time.Second, retry.backoff(1, 86400*time.Second))
+
+	retry.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := retry.backoff(2, 0)
+		assert.True(t, backoff >= 100*time.Millisecond && backoff <= 300*time.Millisecond, backoff)
+
+		// Jitter does not lengthen a backoff that reached the max backoff.
+		backoff = retry.backoff(5, 0)
+		assert.True(t, backoff >= 500*time.Millisecond && backoff <= time.Second, backoff)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	retryAfter := parseRetryAfter(date)
+	assert.True(t, retryAfter > 59*time.Minute && retryAfter <= time.Hour, retryAfter)
+}
+
+func TestValidateConfigRetry(t *testing.T) {
+	tests := []RetryConfig{
+		{MaxAttempts: -1},
+		{MaxAttempts: 3, MinBackoff: 0, MaxBackoff: time.Second},
+		{MaxAttempts: 3, MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+		{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Second, Jitter: 1.5},
+	}
+
+	for _, retry := range tests {
+		_, err := NewClient(NewConfig(RetryOption(retry)))
+		require.Error(t, err, "%+v", retry)
+	}
+}
+
+func TestRetryZeroConfigAttemptsOnce(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	defer testServer.Close()
+
+	c, err := NewClient(Config{
+		WriteURL:          testServer.URL,
+		HTTPClientTimeout: time.Second,
+		UserAgent:         "ua",
+	})
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestRetryAfterCappedToMaxBackoff(t *testing.T) {
+	var attempts atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer testServer.Close()
+
+	c := newRetryTestClient(t, testServer.URL, RetryConfig{
+		MaxAttempts: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, writeErr := c.WriteTimeSeries(ctx, retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, int32(2), attempts.Load())
+}
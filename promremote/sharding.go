@@ -0,0 +1,455 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// defaultVirtualNodes is the number of points each endpoint has on the hash ring.
+const defaultVirtualNodes = 128
+
+// ShardingConfig defines the configuration used to construct a sharding client.
+type ShardingConfig struct {
+	// Endpoints are the endpoints series are split across.
+	Endpoints []EndpointConfig `yaml:"endpoints"`
+
+	// HashLabels are the labels whose values decide the endpoint of a series,
+	// e.g. `tenant`. If empty, all labels of the series are hashed.
+	HashLabels []string `yaml:"hashLabels"`
+
+	// VirtualNodes is the number of points each endpoint has on the hash ring.
+	// The more points, the more evenly series are split. If 0, 128 points are used.
+	VirtualNodes int `yaml:"virtualNodes"`
+
+	// Logger, if not nil, logs changes of the endpoints.
+	Logger *slog.Logger `yaml:"-"`
+}
+
+func (c ShardingConfig) validate() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("sharding client should have at least one endpoint")
+	}
+
+	if c.VirtualNodes < 0 {
+		return fmt.Errorf("virtual nodes should not be negative: %d", c.VirtualNodes)
+	}
+
+	return nil
+}
+
+// ShardingError is returned when the part of a write sent to some of the
+// endpoints failed. The other parts were written.
+type ShardingError struct {
+	// Errors are the errors of the failed endpoints, in the order of the endpoints.
+	Errors []EndpointError
+}
+
+func (e *ShardingError) Error() string {
+	return endpointErrors(e.Errors).message("sharded write")
+}
+
+// StatusCode returns the status code of the first endpoint error caused by a
+// response, otherwise it will be just zero.
+func (e *ShardingError) StatusCode() int {
+	return endpointErrors(e.Errors).statusCode()
+}
+
+// Unwrap returns the errors of the failed endpoints.
+func (e *ShardingError) Unwrap() []error {
+	return endpointErrors(e.Errors).unwrap()
+}
+
+func (e *ShardingError) endpointErrors() []EndpointError {
+	return e.Errors
+}
+
+// ShardingClient is a Client splitting the series of every write across a
+// consistent hash ring of endpoints, so that each series is always written to
+// the same endpoint. When endpoints are added or removed, only the series of
+// the ring segments that change owner move to another endpoint.
+//
+// Metadata is not tied to series, so it is sent to every endpoint written to,
+// and requests without series to all endpoints.
+type ShardingClient struct {
+	hashLabels   []string
+	virtualNodes int
+	logger       *slog.Logger
+
+	mtx       sync.RWMutex
+	endpoints []endpoint
+	ring      hashRing
+}
+
+var (
+	_ Client         = (*ShardingClient)(nil)
+	_ V2Writer       = (*ShardingClient)(nil)
+	_ MetadataWriter = (*ShardingClient)(nil)
+)
+
+// NewShardingClient creates a client splitting writes across the endpoints of the config.
+func NewShardingClient(cfg ShardingConfig) (*ShardingClient, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	virtualNodes := cfg.VirtualNodes
+	if virtualNodes == 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	hashLabels := append([]string(nil), cfg.HashLabels...)
+	sort.Strings(hashLabels)
+
+	c := &ShardingClient{
+		hashLabels:   hashLabels,
+		virtualNodes: virtualNodes,
+		logger:       loggerOrDiscard(cfg.Logger),
+	}
+
+	for _, e := range cfg.Endpoints {
+		endpoint, err := newEndpoint(e)
+		if err != nil {
+			return nil, err
+		}
+		if c.index(endpoint.name) >= 0 {
+			return nil, fmt.Errorf("duplicate sharding endpoint name: %s", endpoint.name)
+		}
+		c.endpoints = append(c.endpoints, endpoint)
+	}
+	c.ring = newHashRing(c.endpoints, c.virtualNodes)
+
+	return c, nil
+}
+
+// AddEndpoint adds an endpoint to the ring, which takes over part of the series of the others.
+func (c *ShardingClient) AddEndpoint(e EndpointConfig) error {
+	endpoint, err := newEndpoint(e)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.index(endpoint.name) >= 0 {
+		return fmt.Errorf("duplicate sharding endpoint name: %s", endpoint.name)
+	}
+
+	// Writes in flight keep using the endpoints they started with.
+	c.endpoints = append(c.endpoints[:len(c.endpoints):len(c.endpoints)], endpoint)
+	c.ring = newHashRing(c.endpoints, c.virtualNodes)
+	c.logger.Info("Added sharding endpoint", "endpoint", endpoint.name, "endpoints", len(c.endpoints))
+
+	return nil
+}
+
+// RemoveEndpoint removes the named endpoint from the ring, whose series are
+// taken over by the others. The last endpoint cannot be removed.
+func (c *ShardingClient) RemoveEndpoint(name string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("unknown sharding endpoint: %s", name)
+	}
+	if len(c.endpoints) == 1 {
+		return errors.New("sharding client should have at least one endpoint")
+	}
+
+	endpoints := make([]endpoint, 0, len(c.endpoints)-1)
+	endpoints = append(endpoints, c.endpoints[:i]...)
+	c.endpoints = append(endpoints, c.endpoints[i+1:]...)
+	c.ring = newHashRing(c.endpoints, c.virtualNodes)
+	c.logger.Info("Removed sharding endpoint", "endpoint", name, "endpoints", len(c.endpoints))
+
+	return nil
+}
+
+// Endpoints returns the names of the endpoints.
+func (c *ShardingClient) Endpoints() []string {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	names := make([]string, len(c.endpoints))
+	for i, e := range c.endpoints {
+		names[i] = e.name
+	}
+
+	return names
+}
+
+// index returns the index of the named endpoint, or -1; c.mtx must be held
+// unless the client is being constructed.
+func (c *ShardingClient) index(name string) int {
+	for i, e := range c.endpoints {
+		if e.name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (c *ShardingClient) WriteTimeSeries(
+	ctx context.Context,
+	seriesList TSList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	endpoints, parts := c.split(len(seriesList), func(i int) []Label {
+		return seriesList[i].Labels
+	})
+
+	return shardWrite(endpoints, parts, opts, func(client Client, indexes []int, opts WriteOptions) (WriteResult, WriteError) {
+		part := make(TSList, len(indexes))
+		for i, index := range indexes {
+			part[i] = seriesList[index]
+		}
+
+		result, writeErr := client.WriteTimeSeries(ctx, part, opts)
+		// Invalid series are reported by their index in the whole series list,
+		// with strict label validation as well.
+		for i := range result.InvalidSeries {
+			result.InvalidSeries[i].Index = indexes[result.InvalidSeries[i].Index]
+		}
+		var validationErr *LabelValidationError
+		if errors.As(writeErr, &validationErr) {
+			for i := range validationErr.Series {
+				validationErr.Series[i].Index = indexes[validationErr.Series[i].Index]
+			}
+		}
+
+		return result, writeErr
+	})
+}
+
+func (c *ShardingClient) WriteProto(
+	ctx context.Context,
+	req *prompb.WriteRequest,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	endpoints, parts := c.split(len(req.Timeseries), func(i int) []Label {
+		return fromPromLabels(req.Timeseries[i].Labels)
+	})
+
+	return shardWrite(endpoints, parts, opts, func(client Client, indexes []int, opts WriteOptions) (WriteResult, WriteError) {
+		part := *req
+		part.Timeseries = make([]prompb.TimeSeries, len(indexes))
+		for i, index := range indexes {
+			part.Timeseries[i] = req.Timeseries[index]
+		}
+
+		return client.WriteProto(ctx, &part, opts)
+	})
+}
+
+func (c *ShardingClient) WriteProtoV2(
+	ctx context.Context,
+	req *writev2.Request,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	if err := validateSymbolRefs(req); err != nil {
+		return WriteResult{}, writeError{err: err}
+	}
+
+	endpoints, parts := c.split(len(req.Timeseries), func(i int) []Label {
+		return fromPromLabels(desymbolizeLabels(req.Timeseries[i].LabelsRefs, req.Symbols))
+	})
+
+	return shardWrite(endpoints, parts, opts, func(client Client, indexes []int, opts WriteOptions) (WriteResult, WriteError) {
+		// Every part keeps the whole symbol table, so that the label refs of its series stay valid.
+		part := *req
+		part.Timeseries = make([]writev2.TimeSeries, len(indexes))
+		for i, index := range indexes {
+			part.Timeseries[i] = req.Timeseries[index]
+		}
+
+		return writeProtoV2(ctx, client, &part, opts)
+	})
+}
+
+func (c *ShardingClient) WriteMetadata(
+	ctx context.Context,
+	md MetadataList,
+	opts WriteOptions,
+) (WriteResult, WriteError) {
+	endpoints, parts := c.split(0, nil)
+
+	return shardWrite(endpoints, parts, opts, func(client Client, _ []int, opts WriteOptions) (WriteResult, WriteError) {
+		return writeMetadata(ctx, client, md, opts)
+	})
+}
+
+// split returns the endpoints along with the indexes of the n series owned by
+// each of them. Without series, every endpoint is written to.
+func (c *ShardingClient) split(n int, labelsOf func(int) []Label) ([]endpoint, [][]int) {
+	c.mtx.RLock()
+	endpoints, ring := c.endpoints, c.ring
+	c.mtx.RUnlock()
+
+	parts := make([][]int, len(endpoints))
+	if n == 0 {
+		for i := range parts {
+			parts[i] = []int{}
+		}
+		return endpoints, parts
+	}
+
+	for i := 0; i < n; i++ {
+		owner := ring.owner(shardHash(labelsOf(i), c.hashLabels))
+		parts[owner] = append(parts[owner], i)
+	}
+
+	return endpoints, parts
+}
+
+// shardWrite writes the parts concurrently to the endpoints owning them,
+// skipping endpoints without a part. The result is the one of the first
+// successful endpoint, with the invalid series of all of them.
+func shardWrite(
+	endpoints []endpoint,
+	parts [][]int,
+	opts WriteOptions,
+	write func(Client, []int, WriteOptions) (WriteResult, WriteError),
+) (WriteResult, WriteError) {
+	var (
+		results = make([]WriteResult, len(endpoints))
+		errs    = make([]WriteError, len(endpoints))
+		wg      sync.WaitGroup
+	)
+	for i, e := range endpoints {
+		if parts[i] == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = write(e.client, parts[i], e.writeOptions(opts))
+		}()
+	}
+	wg.Wait()
+
+	var (
+		result    WriteResult
+		succeeded bool
+		failed    []EndpointError
+	)
+	for i, e := range endpoints {
+		if parts[i] == nil {
+			continue
+		}
+
+		result.InvalidSeries = append(result.InvalidSeries, results[i].InvalidSeries...)
+		if errs[i] != nil {
+			failed = append(failed, EndpointError{Endpoint: e.name, Err: errs[i]})
+			continue
+		}
+		if !succeeded {
+			result.StatusCode = results[i].StatusCode
+			succeeded = true
+		}
+	}
+	sort.Slice(result.InvalidSeries, func(i, j int) bool {
+		return result.InvalidSeries[i].Index < result.InvalidSeries[j].Index
+	})
+
+	if len(failed) > 0 {
+		return result, &ShardingError{Errors: failed}
+	}
+
+	return result, nil
+}
+
+// shardHash returns the hash deciding the endpoint of a series: the hash of
+// the values of the hash labels, which must be sorted, or of all labels if none are given.
+func shardHash(labels []Label, hashLabels []string) uint64 {
+	if len(hashLabels) == 0 {
+		return labelsHash(labels)
+	}
+
+	values := make(map[string]string, len(hashLabels))
+	for _, l := range labels {
+		values[l.Name] = l.Value
+	}
+
+	h := xxhash.New()
+	for _, name := range hashLabels {
+		h.WriteString(values[name])
+		h.Write([]byte{0xff})
+	}
+
+	return h.Sum64()
+}
+
+// hashRing is a consistent hash ring on which each endpoint owns the ring
+// segments ending at its virtual nodes.
+type hashRing struct {
+	tokens []uint64
+	// owners are the indexes of the endpoints owning the tokens.
+	owners []int
+}
+
+// newHashRing places the virtual nodes of the endpoints on the ring by the hash
+// of their name, so that the ring only changes where endpoints are added or removed.
+func newHashRing(endpoints []endpoint, virtualNodes int) hashRing {
+	type node struct {
+		token uint64
+		owner int
+	}
+
+	nodes := make([]node, 0, len(endpoints)*virtualNodes)
+	for i, e := range endpoints {
+		for v := 0; v < virtualNodes; v++ {
+			nodes = append(nodes, node{token: xxhash.Sum64String(e.name + "#" + strconv.Itoa(v)), owner: i})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].token < nodes[j].token })
+
+	r := hashRing{tokens: make([]uint64, len(nodes)), owners: make([]int, len(nodes))}
+	for i, n := range nodes {
+		r.tokens[i], r.owners[i] = n.token, n.owner
+	}
+
+	return r
+}
+
+// owner returns the index of the endpoint owning the hash, which is the one
+// of the first virtual node at or after it, wrapping around the ring.
+func (r hashRing) owner(hash uint64) int {
+	i := sort.Search(len(r.tokens), func(i int) bool { return r.tokens[i] >= hash })
+	if i == len(r.tokens) {
+		i = 0
+	}
+
+	return r.owners[i]
+}
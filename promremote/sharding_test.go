@@ -0,0 +1,315 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newShardingTestClient(t *testing.T, n int, hashLabels ...string) (*ShardingClient, map[string]*recordingClient) {
+	clients := make(map[string]*recordingClient, n)
+	var endpoints []EndpointConfig
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("receiver-%d", i)
+		clients[name] = &recordingClient{}
+		endpoints = append(endpoints, EndpointConfig{Name: name, Client: clients[name]})
+	}
+
+	c, err := NewShardingClient(ShardingConfig{Endpoints: endpoints, HashLabels: hashLabels})
+	require.NoError(t, err)
+
+	return c, clients
+}
+
+func shardingTestSeries(n int) TSList {
+	series := make(TSList, n)
+	for i := range series {
+		series[i] = TimeSeries{
+			Labels: []Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "pod", Value: fmt.Sprintf("api-%d", i)},
+				{Name: "tenant", Value: fmt.Sprintf("tenant-%d", i%7)},
+			},
+			Datapoint: Datapoint{Timestamp: now, Value: float64(i)},
+		}
+	}
+
+	return series
+}
+
+// owners returns the name of the endpoint each series is written to.
+func owners(c *ShardingClient, series TSList) []string {
+	endpoints, parts := c.split(len(series), func(i int) []Label { return series[i].Labels })
+
+	names := make([]string, len(series))
+	for i, part := range parts {
+		for _, index := range part {
+			names[index] = endpoints[i].name
+		}
+	}
+
+	return names
+}
+
+func TestShardingClientSplitsByHashLabels(t *testing.T) {
+	c, clients := newShardingTestClient(t, 3, "tenant")
+	series := shardingTestSeries(100)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), series, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	tenants := map[string]string{}
+	written := 0
+	for name, client := range clients {
+		for _, batch := range client.written() {
+			for _, ts := range batch {
+				written++
+				tenant := ts.Labels[2].Value
+				if owner, ok := tenants[tenant]; ok {
+					assert.Equal(t, owner, name, "series of %s written to several endpoints", tenant)
+				}
+				tenants[tenant] = name
+			}
+		}
+	}
+	assert.Equal(t, len(series), written)
+	assert.Len(t, tenants, 7)
+}
+
+func TestShardingClientRebalance(t *testing.T) {
+	c, _ := newShardingTestClient(t, 3)
+	series := shardingTestSeries(3000)
+	before := owners(c, series)
+
+	counts := map[string]int{}
+	for _, owner := range before {
+		counts[owner]++
+	}
+	for _, count := range counts {
+		assert.InDelta(t, 1000, count, 300)
+	}
+
+	require.NoError(t, c.AddEndpoint(EndpointConfig{Name: "receiver-3", Client: &recordingClient{}}))
+	assert.Equal(t, []string{"receiver-0", "receiver-1", "receiver-2", "receiver-3"}, c.Endpoints())
+
+	added := owners(c, series)
+	moved := 0
+	for i := range series {
+		if added[i] != before[i] {
+			moved++
+			assert.Equal(t, "receiver-3", added[i])
+		}
+	}
+	assert.InDelta(t, 750, moved, 250)
+
+	require.NoError(t, c.RemoveEndpoint("receiver-1"))
+	removed := owners(c, series)
+	for i := range series {
+		if added[i] != "receiver-1" {
+			assert.Equal(t, added[i], removed[i])
+		} else {
+			assert.NotEqual(t, "receiver-1", removed[i])
+		}
+	}
+
+	// Removing the new endpoint brings back the original ring without receiver-1.
+	require.NoError(t, c.RemoveEndpoint("receiver-3"))
+	for i, owner := range owners(c, series) {
+		if before[i] != "receiver-1" {
+			assert.Equal(t, before[i], owner)
+		}
+	}
+}
+
+func TestShardingClientWriteProto(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		received = map[string]*prompb.WriteRequest{}
+	)
+	var endpoints []EndpointConfig
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("receiver-%d", i)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := decodeWriteRequest(t, r)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			received[name] = req
+		}))
+		defer server.Close()
+
+		endpoints = append(endpoints, EndpointConfig{Name: name, Config: NewConfig(WriteURLOption(server.URL))})
+	}
+
+	c, err := NewShardingClient(ShardingConfig{Endpoints: endpoints})
+	require.NoError(t, err)
+
+	series := shardingTestSeries(20)
+	req, err := series.toPromWriteRequest()
+	require.NoError(t, err)
+	req.Metadata = []prompb.MetricMetadata{{MetricFamilyName: "http_requests_total", Type: prompb.MetricMetadata_COUNTER}}
+
+	_, writeErr := c.WriteProto(context.Background(), req, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	require.Len(t, received, 2)
+	total := 0
+	for _, r := range received {
+		total += len(r.Timeseries)
+		assert.Equal(t, req.Metadata, r.Metadata)
+	}
+	assert.Equal(t, len(series), total)
+}
+
+func TestShardingClientErrors(t *testing.T) {
+	c, clients := newShardingTestClient(t, 3)
+	clients["receiver-1"].writeFn = func(context.Context, TSList) WriteError {
+		return writeError{err: errors.New("unavailable"), code: http.StatusServiceUnavailable, recoverable: true}
+	}
+
+	series := shardingTestSeries(100)
+	_, writeErr := c.WriteTimeSeries(context.Background(), series, WriteOptions{})
+	require.Error(t, writeErr)
+
+	var se *ShardingError
+	require.True(t, errors.As(writeErr, &se))
+	require.Len(t, se.Errors, 1)
+	assert.Equal(t, "receiver-1", se.Errors[0].Endpoint)
+	assert.Equal(t, http.StatusServiceUnavailable, writeErr.StatusCode())
+	assert.True(t, recoverable(writeErr))
+
+	// The parts of the other endpoints are still written.
+	assert.Len(t, clients["receiver-0"].written(), 1)
+	assert.Len(t, clients["receiver-2"].written(), 1)
+}
+
+func TestShardingClientInvalidSeries(t *testing.T) {
+	var endpoints []EndpointConfig
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		endpoints = append(endpoints, EndpointConfig{Config: NewConfig(
+			WriteURLOption(server.URL),
+			LabelValidationOption(LabelValidationLenient),
+		)})
+	}
+
+	c, err := NewShardingClient(ShardingConfig{Endpoints: endpoints})
+	require.NoError(t, err)
+
+	series := shardingTestSeries(20)
+	for _, i := range []int{3, 11, 17} {
+		series[i].Labels = series[i].Labels[1:]
+	}
+
+	r, writeErr := c.WriteTimeSeries(context.Background(), series, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	var indexes []int
+	for _, invalid := range r.InvalidSeries {
+		indexes = append(indexes, invalid.Index)
+		assert.Equal(t, series[invalid.Index].Labels, invalid.Labels)
+	}
+	assert.Equal(t, []int{3, 11, 17}, indexes)
+}
+
+func TestShardingClientWriteProtoV2InvalidSymbolRefs(t *testing.T) {
+	c, clients := newShardingTestClient(t, 2)
+
+	_, writeErr := c.WriteProtoV2(context.Background(), &writev2.Request{
+		Symbols:    []string{"__name__", "foo_bar"},
+		Timeseries: []writev2.TimeSeries{{LabelsRefs: []uint32{0, 5}}},
+	}, WriteOptions{})
+	require.Error(t, writeErr)
+	for _, client := range clients {
+		assert.Empty(t, client.written())
+	}
+}
+
+func TestShardingClientInvalidSeriesStrict(t *testing.T) {
+	var endpoints []EndpointConfig
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		endpoints = append(endpoints, EndpointConfig{Config: NewConfig(
+			WriteURLOption(server.URL),
+			LabelValidationOption(LabelValidationStrict),
+		)})
+	}
+
+	c, err := NewShardingClient(ShardingConfig{Endpoints: endpoints})
+	require.NoError(t, err)
+
+	series := shardingTestSeries(20)
+	for _, i := range []int{3, 11, 17} {
+		series[i].Labels = series[i].Labels[1:]
+	}
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), series, WriteOptions{})
+	require.Error(t, writeErr)
+
+	var se *ShardingError
+	require.True(t, errors.As(writeErr, &se))
+
+	var indexes []int
+	for _, err := range se.Errors {
+		var validationErr *LabelValidationError
+		require.True(t, errors.As(err.Err, &validationErr))
+		for _, invalid := range validationErr.Series {
+			indexes = append(indexes, invalid.Index)
+			assert.Equal(t, series[invalid.Index].Labels, invalid.Labels)
+		}
+	}
+	assert.ElementsMatch(t, []int{3, 11, 17}, indexes)
+}
+
+func TestShardingClientEndpointValidation(t *testing.T) {
+	endpoint := EndpointConfig{Name: "receiver", Client: &recordingClient{}}
+
+	for _, cfg := range []ShardingConfig{
+		{},
+		{Endpoints: []EndpointConfig{endpoint}, VirtualNodes: -1},
+		{Endpoints: []EndpointConfig{endpoint, endpoint}},
+		{Endpoints: []EndpointConfig{{Config: NewConfig(WriteURLOption(""))}}},
+	} {
+		_, err := NewShardingClient(cfg)
+		require.Error(t, err)
+	}
+
+	c, err := NewShardingClient(ShardingConfig{Endpoints: []EndpointConfig{endpoint}})
+	require.NoError(t, err)
+	require.Error(t, c.AddEndpoint(endpoint))
+	require.Error(t, c.RemoveEndpoint("unknown"))
+	require.Error(t, c.RemoveEndpoint("receiver"))
+}
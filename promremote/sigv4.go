@@ -0,0 +1,154 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const defaultSigV4Service = "aps"
+
+// SigV4 configures AWS Signature Version 4 signing of requests, as used by
+// Amazon Managed Service for Prometheus. If AccessKey is not set, credentials
+// are taken from the default AWS credential chain.
+type SigV4 struct {
+	// Region is the AWS region. If blank, it is taken from the AWS environment.
+	Region string `yaml:"region"`
+
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+
+	// Profile is the shared config profile used when AccessKey is not set.
+	Profile string `yaml:"profile"`
+
+	// RoleARN, if set, is assumed with the credentials above to sign requests.
+	RoleARN string `yaml:"roleARN"`
+
+	// Service is the name of the signed service, "aps" if blank.
+	Service string `yaml:"service"`
+}
+
+func (s SigV4) validate() error {
+	if (s.AccessKey == "") != (s.SecretKey == "") {
+		return errors.New("sigv4 access key and secret key should be set together")
+	}
+
+	if s.AccessKey != "" && s.Profile != "" {
+		return errors.New("at most one of sigv4 access key and profile should be set")
+	}
+
+	return nil
+}
+
+// sigV4Signer signs requests with credentials that are cached and refreshed
+// by the AWS SDK.
+type sigV4Signer struct {
+	signer      *v4.Signer
+	credentials aws.CredentialsProvider
+	region      string
+	service     string
+}
+
+func newSigV4Signer(cfg SigV4) (*sigV4Signer, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	if cfg.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(cfg.Profile))
+	}
+	if cfg.AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, ""),
+		))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load sigv4 config: %v", err)
+	}
+
+	if awsCfg.Region == "" {
+		return nil, errors.New("sigv4 region should not be blank")
+	}
+
+	creds := awsCfg.Credentials
+	if cfg.RoleARN != "" {
+		creds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.RoleARN))
+	}
+	if creds == nil {
+		return nil, errors.New("no sigv4 credentials found")
+	}
+
+	service := cfg.Service
+	if service == "" {
+		service = defaultSigV4Service
+	}
+
+	return &sigV4Signer{
+		signer:      v4.NewSigner(),
+		credentials: creds,
+		region:      awsCfg.Region,
+		service:     service,
+	}, nil
+}
+
+func (s *sigV4Signer) authorize(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read request body: %v", err)
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	creds, err := s.credentials.Retrieve(req.Context())
+	if err != nil {
+		return fmt.Errorf("unable to retrieve sigv4 credentials: %v", err)
+	}
+
+	payloadHash := sha256.Sum256(body)
+	if err := s.signer.SignHTTP(
+		req.Context(), creds, req, hex.EncodeToString(payloadHash[:]), s.service, s.region, time.Now(),
+	); err != nil {
+		return fmt.Errorf("unable to sign request: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifySigV4 re-signs the received request with the given credentials and
+// reports whether the signature matches the one it was sent with.
+func verifySigV4(t *testing.T, r *http.Request, creds aws.Credentials, service, region string) bool {
+	authorization := r.Header.Get("Authorization")
+	signedAt, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), bytes.NewReader(body))
+	require.NoError(t, err)
+
+	// Only copy the headers that were signed, as the transport adds others.
+	const signedHeadersPrefix = "SignedHeaders="
+	for _, part := range strings.Split(authorization, ", ") {
+		if strings.HasPrefix(part, signedHeadersPrefix) {
+			for _, name := range strings.Split(strings.TrimPrefix(part, signedHeadersPrefix), ";") {
+				if name != "host" {
+					req.Header.Set(name, r.Header.Get(name))
+				}
+			}
+		}
+	}
+
+	payloadHash := sha256.Sum256(body)
+	require.NoError(t, v4.NewSigner().SignHTTP(
+		context.Background(), creds, req, hex.EncodeToString(payloadHash[:]), service, region, signedAt,
+	))
+
+	return authorization != "" && req.Header.Get("Authorization") == authorization
+}
+
+func TestClientSigV4(t *testing.T) {
+	tests := []struct {
+		name            string
+		service         string
+		expectedService string
+	}{
+		{name: "default service", expectedService: "aps"},
+		{name: "custom service", service: "execute-api", expectedService: "execute-api"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var verified bool
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				creds := aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}
+				verified = verifySigV4(t, r, creds, test.expectedService, "eu-west-1")
+				if !verified {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}))
+			defer testServer.Close()
+
+			c, err := NewClient(NewConfig(
+				WriteURLOption(testServer.URL),
+				SigV4Option(SigV4{
+					Region:    "eu-west-1",
+					AccessKey: "AKID",
+					SecretKey: "SECRET",
+					Service:   test.service,
+				}),
+			))
+			require.NoError(t, err)
+
+			_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+			require.NoError(t, writeErr)
+			assert.True(t, verified)
+		})
+	}
+}
+
+func TestClientSigV4WrongCredentials(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds := aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "OTHER"}
+		if !verifySigV4(t, r, creds, "aps", "eu-west-1") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		SigV4Option(SigV4{Region: "eu-west-1", AccessKey: "AKID", SecretKey: "SECRET"}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, http.StatusForbidden, writeErr.StatusCode())
+}
+
+func TestValidateConfigSigV4(t *testing.T) {
+	tests := []SigV4{
+		{Region: "eu-west-1", AccessKey: "AKID"},
+		{Region: "eu-west-1", SecretKey: "SECRET"},
+		{Region: "eu-west-1", AccessKey: "AKID", SecretKey: "SECRET", Profile: "default"},
+	}
+
+	for _, sigV4 := range tests {
+		_, err := NewClient(NewConfig(SigV4Option(sigV4)))
+		require.Error(t, err, "%+v", sigV4)
+	}
+
+	_, err := NewClient(NewConfig(
+		SigV4Option(SigV4{Region: "eu-west-1", AccessKey: "AKID", SecretKey: "SECRET"}),
+		BearerTokenOption("token"),
+	))
+	require.Error(t, err)
+}
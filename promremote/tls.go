@@ -0,0 +1,208 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// TLSConfig configures TLS connections to the remote endpoints. The CA and
+// client certificate files are reloaded whenever they change.
+type TLSConfig struct {
+	// CAFile is the PEM file of the CAs server certificates are verified with.
+	// If blank, the system roots are used.
+	CAFile string `yaml:"caFile"`
+
+	// CertFile and KeyFile are the PEM files of the client certificate and key.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// ServerName is used to verify the hostname of the server certificate.
+	ServerName string `yaml:"serverName"`
+
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+
+	// MinVersion is the minimum TLS version, one of TLS10, TLS11, TLS12 or TLS13.
+	MinVersion string `yaml:"minVersion"`
+}
+
+func (c Config) validateTLS() error {
+	if c.TLS == nil {
+		return nil
+	}
+
+	if c.HTTPClient != nil {
+		return errors.New("tls config should not be set with a custom HTTP client")
+	}
+
+	return c.TLS.validate()
+}
+
+func (t TLSConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("tls cert file and key file should be set together")
+	}
+
+	if _, ok := tlsVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		return fmt.Errorf("unknown tls min version: %s", t.MinVersion)
+	}
+
+	return nil
+}
+
+// tlsRoundTripper sends requests through a transport configured by a TLSConfig.
+// Client certificates are reloaded on every handshake, while a change of the CA
+// file replaces the transport since the root CAs of a tls.Config are fixed.
+type tlsRoundTripper struct {
+	cfg      TLSConfig
+	ca       *secret
+	cert     *secret
+	key      *secret
+	certPair *tls.Certificate
+
+	mu        sync.Mutex
+	caPEM     string
+	certPEM   string
+	keyPEM    string
+	transport *http.Transport
+}
+
+func newTLSRoundTripper(cfg TLSConfig) (*tlsRoundTripper, error) {
+	rt := &tlsRoundTripper{cfg: cfg}
+	if cfg.CAFile != "" {
+		rt.ca = newSecret("", cfg.CAFile)
+	}
+	if cfg.CertFile != "" {
+		rt.cert = newSecret("", cfg.CertFile)
+		rt.key = newSecret("", cfg.KeyFile)
+		if _, err := rt.clientCertificate(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := rt.currentTransport(); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+func (rt *tlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := rt.currentTransport()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	return transport.RoundTrip(req)
+}
+
+// currentTransport returns the transport for the current CA file, replacing
+// the previous one if the file changed.
+func (rt *tlsRoundTripper) currentTransport() (*http.Transport, error) {
+	var caPEM string
+	if rt.ca != nil {
+		var err error
+		if caPEM, err = rt.ca.get(); err != nil {
+			return nil, err
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.transport != nil && caPEM == rt.caPEM {
+		return rt.transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         rt.cfg.ServerName,
+		InsecureSkipVerify: rt.cfg.InsecureSkipVerify,
+		MinVersion:         tlsVersions[rt.cfg.MinVersion],
+	}
+	if rt.ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, fmt.Errorf("unable to use specified CA file: %s", rt.cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if rt.cert != nil {
+		tlsConfig.GetClientCertificate = rt.clientCertificate
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if rt.transport != nil {
+		rt.transport.CloseIdleConnections()
+	}
+	rt.transport = transport
+	rt.caPEM = caPEM
+
+	return transport, nil
+}
+
+// clientCertificate returns the client certificate, parsing it again if the
+// certificate or key file changed.
+func (rt *tlsRoundTripper) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certPEM, err := rt.cert.get()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := rt.key.get()
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.certPair != nil && certPEM == rt.certPEM && keyPEM == rt.keyPEM {
+		return rt.certPair, nil
+	}
+
+	certPair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("unable to use specified client cert (%s) and key (%s): %v", rt.cfg.CertFile, rt.cfg.KeyFile, err)
+	}
+
+	rt.certPair = &certPair
+	rt.certPEM = certPEM
+	rt.keyPEM = keyPEM
+
+	return rt.certPair, nil
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert returns a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeRotatedFile writes the file with a later modification time, as a rotation would.
+func writeRotatedFile(t *testing.T, path string, data []byte, rotation int) {
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	modTime := time.Now().Add(time.Duration(rotation) * time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// newTLSTestServer returns a TLS server with the given certificate that records
+// the common name of the client certificate of every request.
+func newTLSTestServer(t *testing.T, serverCert *testCert, clientCA *testCert) (*httptest.Server, *[]string) {
+	var clientNames []string
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientNames = append(clientNames, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	testServer.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		testServer.TLS.ClientCAs = pool
+		testServer.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Handshake on every request so that rotated client certificates are used.
+	testServer.Config.SetKeepAlivesEnabled(false)
+	testServer.StartTLS()
+	t.Cleanup(testServer.Close)
+
+	return testServer, &clientNames
+}
+
+func TestClientTLSCAFileReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newTestCert(t, "old-ca", nil)
+	newCA := newTestCert(t, "new-ca", nil)
+	testServer, _ := newTLSTestServer(t, newTestCert(t, "server", newCA), nil)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writeRotatedFile(t, caFile, oldCA.certPEM, 0)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		TLSOption(TLSConfig{CAFile: caFile}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+
+	writeRotatedFile(t, caFile, newCA.certPEM, 1)
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+}
+
+func TestClientMutualTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	testServer, clientNames := newTLSTestServer(t, newTestCert(t, "server", ca), ca)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writeRotatedFile(t, caFile, ca.certPEM, 0)
+
+	first := newTestCert(t, "first", ca)
+	writeRotatedFile(t, certFile, first.certPEM, 0)
+	writeRotatedFile(t, keyFile, first.keyPEM, 0)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		HTTPClientTimeoutOption(10*time.Second),
+		TLSOption(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "TLS12"}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	second := newTestCert(t, "second", ca)
+	writeRotatedFile(t, certFile, second.certPEM, 1)
+	writeRotatedFile(t, keyFile, second.keyPEM, 1)
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+
+	assert.Equal(t, []string{"first", "second"}, *clientNames)
+}
+
+func TestClientTLSInsecureSkipVerify(t *testing.T) {
+	testServer, _ := newTLSTestServer(t, newTestCert(t, "server", newTestCert(t, "ca", nil)), nil)
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		TLSOption(TLSConfig{InsecureSkipVerify: true}),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), retryTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+}
+
+func TestReaderTLSServerName(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	testServer, _ := newTLSTestServer(t, newTestCert(t, "server", ca), nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeRotatedFile(t, caFile, ca.certPEM, 0)
+
+	// The server certificate has no DNS names, so verification fails for any server name.
+	r, err := NewReader(NewConfig(
+		ReadURLOption(testServer.URL),
+		TLSOption(TLSConfig{CAFile: caFile, ServerName: "example.com"}),
+	))
+	require.NoError(t, err)
+
+	_, readErr := r.Read(context.Background(), testQuery(), ReadOptions{})
+	require.Error(t, readErr)
+	assert.Contains(t, readErr.Error(), "example.com")
+}
+
+func TestValidateConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	require.NoError(t, os.WriteFile(invalidFile, []byte("not a certificate"), 0600))
+
+	tests := [][]ConfigOption{
+		{TLSOption(TLSConfig{CertFile: "/client.pem"})},
+		{TLSOption(TLSConfig{MinVersion: "SSL3"})},
+		{TLSOption(TLSConfig{CAFile: filepath.Join(dir, "missing.pem")})},
+		{TLSOption(TLSConfig{CAFile: invalidFile})},
+		{TLSOption(TLSConfig{CertFile: invalidFile, KeyFile: invalidFile})},
+		{TLSOption(TLSConfig{}), HTTPClientOption(&http.Client{})},
+	}
+
+	for _, opts := range tests {
+		_, err := NewClient(NewConfig(opts...))
+		require.Error(t, err)
+	}
+}
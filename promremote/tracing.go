@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the client.
+const tracerName = "github.com/ldmonster/prometheus_remote_client_golang/promremote"
+
+const (
+	seriesAttribute       = attribute.Key("promremote.series")
+	samplesAttribute      = attribute.Key("promremote.samples")
+	payloadBytesAttribute = attribute.Key("promremote.payload_bytes")
+	retriesAttribute      = attribute.Key("promremote.retries")
+	protoMsgAttribute     = attribute.Key("promremote.proto_msg")
+)
+
+// startWriteSpan starts the client span of a write request, which covers
+// marshaling, compressing and sending it, retries included.
+func (c *client) startWriteSpan(
+	ctx context.Context,
+	msg WriteProtoMsg,
+	stats writeStats,
+) (context.Context, trace.Span) {
+	name := "promremote.WriteProto"
+	if msg == WriteProtoMsgV2 {
+		name = "promremote.WriteProtoV2"
+	}
+
+	return c.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.URLFull(c.endpointURL),
+			protoMsgAttribute.String(string(msg)),
+			seriesAttribute.Int(stats.series),
+			samplesAttribute.Int(stats.samples),
+		),
+	)
+}
+
+// endWriteSpan records the outcome of the write and ends its span.
+func endWriteSpan(span trace.Span, result WriteResult, writeErr WriteError) {
+	defer span.End()
+
+	code := result.StatusCode
+	if writeErr != nil && writeErr.StatusCode() != 0 {
+		code = writeErr.StatusCode()
+	}
+	if code != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+	}
+
+	if writeErr != nil {
+		span.RecordError(writeErr)
+		span.SetStatus(codes.Error, writeErr.Error())
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+)
+
+// LabelValidation is the mode in which WriteTimeSeries validates and normalises
+// the labels of series before sending them. If blank, labels are sent verbatim.
+//
+// In both modes labels with empty values are dropped, since Prometheus treats
+// them as absent, and labels are sorted by name. Series that are still invalid,
+// because of a missing metric name, duplicate label names, label names not
+// matching the classic Prometheus pattern, whatever the global
+// model.NameValidationScheme, or values that are not valid UTF-8, are handled
+// according to the mode.
+type LabelValidation string
+
+const (
+	// LabelValidationLenient drops invalid series, sends the other ones and
+	// reports the dropped series in WriteResult.InvalidSeries.
+	LabelValidationLenient LabelValidation = "lenient"
+	// LabelValidationStrict fails the whole write with a *LabelValidationError
+	// if any series is invalid.
+	LabelValidationStrict LabelValidation = "strict"
+)
+
+var (
+	// ErrMissingMetricName is reported for series without a __name__ label.
+	ErrMissingMetricName = errors.New("missing metric name")
+
+	// ErrDuplicateLabelName is reported for series with several labels of the same name.
+	ErrDuplicateLabelName = errors.New("duplicate label name")
+
+	// ErrInvalidLabelName is reported for series with a label name that does
+	// not match the classic Prometheus pattern [a-zA-Z_][a-zA-Z0-9_]*.
+	ErrInvalidLabelName = errors.New("invalid label name")
+
+	// ErrInvalidLabelValue is reported for series with a label value that is not valid UTF-8.
+	ErrInvalidLabelValue = errors.New("invalid label value")
+)
+
+// SeriesError is the reason a series failed label validation.
+type SeriesError struct {
+	// Index is the index of the series in the written TSList.
+	Index int
+	// Labels are the labels of the series as given.
+	Labels []Label
+	// Err wraps one of ErrMissingMetricName, ErrDuplicateLabelName,
+	// ErrInvalidLabelName or ErrInvalidLabelValue.
+	Err error
+}
+
+func (e SeriesError) Error() string {
+	return fmt.Sprintf("series %d %v: %v", e.Index, e.Labels, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e SeriesError) Unwrap() error {
+	return e.Err
+}
+
+// LabelValidationError is returned by strict label validation when series are invalid.
+type LabelValidationError struct {
+	Series []SeriesError
+}
+
+func (e *LabelValidationError) Error() string {
+	msgs := make([]string, len(e.Series))
+	for i, s := range e.Series {
+		msgs[i] = s.Error()
+	}
+	return fmt.Sprintf("%d invalid series: %s", len(e.Series), strings.Join(msgs, "; "))
+}
+
+func (v LabelValidation) validate() error {
+	switch v {
+	case "", LabelValidationLenient, LabelValidationStrict:
+		return nil
+	default:
+		return fmt.Errorf("unknown label validation mode: %s", v)
+	}
+}
+
+// normaliseLabels returns a sorted copy of the labels without empty values, or
+// an error if they do not make a valid series.
+func normaliseLabels(labels []Label) ([]Label, error) {
+	normalised := make([]Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Value != "" {
+			normalised = append(normalised, l)
+		}
+	}
+
+	sort.SliceStable(normalised, func(i, j int) bool {
+		return normalised[i].Name < normalised[j].Name
+	})
+
+	hasName := false
+	for i, l := range normalised {
+		if !model.LabelName(l.Name).IsValidLegacy() {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabelName, l.Name)
+		}
+		if !utf8.ValidString(l.Value) {
+			return nil, fmt.Errorf("%w for label %q: %q", ErrInvalidLabelValue, l.Name, l.Value)
+		}
+		if i > 0 && normalised[i-1].Name == l.Name {
+			return nil, fmt.Errorf("%w: %q", ErrDuplicateLabelName, l.Name)
+		}
+		if l.Name == model.MetricNameLabel {
+			hasName = true
+		}
+	}
+
+	if !hasName {
+		return nil, ErrMissingMetricName
+	}
+
+	return normalised, nil
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormaliseLabels(t *testing.T) {
+	labels, err := normaliseLabels([]Label{
+		{Name: "job", Value: "api"},
+		{Name: "env", Value: ""},
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "code", Value: "200"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "code", Value: "200"},
+		{Name: "job", Value: "api"},
+	}, labels)
+
+	tests := []struct {
+		labels      []Label
+		expectedErr error
+	}{
+		{labels: []Label{{Name: "job", Value: "api"}}, expectedErr: ErrMissingMetricName},
+		{labels: []Label{{Name: "__name__", Value: ""}}, expectedErr: ErrMissingMetricName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "job", Value: "b"}}, expectedErr: ErrDuplicateLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "", Value: "a"}}, expectedErr: ErrInvalidLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "foo-bar", Value: "a"}}, expectedErr: ErrInvalidLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "1abc", Value: "a"}}, expectedErr: ErrInvalidLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "a b", Value: "a"}}, expectedErr: ErrInvalidLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "\xff", Value: "a"}}, expectedErr: ErrInvalidLabelName},
+		{labels: []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "\xff"}}, expectedErr: ErrInvalidLabelValue},
+	}
+
+	for _, test := range tests {
+		_, err := normaliseLabels(test.labels)
+		assert.True(t, errors.Is(err, test.expectedErr), "%v: %v", test.labels, err)
+	}
+}
+
+var labelValidationTestTSList = TSList{
+	{
+		Labels:    []Label{{Name: "job", Value: "api"}, {Name: "__name__", Value: "up"}, {Name: "env", Value: ""}},
+		Datapoint: Datapoint{Timestamp: now, Value: 1},
+	},
+	{
+		Labels:    []Label{{Name: "job", Value: "api"}},
+		Datapoint: Datapoint{Timestamp: now, Value: 2},
+	},
+}
+
+func TestClientLabelValidationLenient(t *testing.T) {
+	var req *prompb.WriteRequest
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = decodeWriteRequest(t, r)
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		LabelValidationOption(LabelValidationLenient),
+	))
+	require.NoError(t, err)
+
+	result, writeErr := c.WriteTimeSeries(context.Background(), labelValidationTestTSList, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	require.Len(t, result.InvalidSeries, 1)
+	assert.Equal(t, 1, result.InvalidSeries[0].Index)
+	assert.Equal(t, labelValidationTestTSList[1].Labels, result.InvalidSeries[0].Labels)
+	assert.True(t, errors.Is(result.InvalidSeries[0], ErrMissingMetricName))
+
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "up"},
+		{Name: "job", Value: "api"},
+	}, req.Timeseries[0].Labels)
+
+	// The labels of the written series are left untouched.
+	assert.Len(t, labelValidationTestTSList[0].Labels, 3)
+}
+
+func TestClientLabelValidationLenientAllInvalid(t *testing.T) {
+	c, err := NewClient(NewConfig(
+		WriteURLOption("http://localhost:0"),
+		LabelValidationOption(LabelValidationLenient),
+	))
+	require.NoError(t, err)
+
+	result, writeErr := c.WriteTimeSeries(context.Background(), labelValidationTestTSList[1:], WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Len(t, result.InvalidSeries, 1)
+}
+
+func TestClientLabelValidationStrict(t *testing.T) {
+	var requests int
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		LabelValidationOption(LabelValidationStrict),
+	))
+	require.NoError(t, err)
+
+	_, writeErr := c.WriteTimeSeries(context.Background(), labelValidationTestTSList, WriteOptions{})
+	require.Error(t, writeErr)
+	assert.Equal(t, 0, writeErr.StatusCode())
+	assert.Equal(t, 0, requests)
+
+	var validationErr *LabelValidationError
+	require.True(t, errors.As(writeErr, &validationErr))
+	require.Len(t, validationErr.Series, 1)
+	assert.Equal(t, 1, validationErr.Series[0].Index)
+	assert.True(t, errors.Is(validationErr.Series[0], ErrMissingMetricName))
+
+	_, writeErr = c.WriteTimeSeries(context.Background(), labelValidationTestTSList[:1], WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, 1, requests)
+}
+
+func TestValidateConfigLabelValidation(t *testing.T) {
+	_, err := NewClient(NewConfig(LabelValidationOption("sometimes")))
+	require.Error(t, err)
+}
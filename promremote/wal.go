@@ -0,0 +1,616 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const (
+	walRecordHeaderSize = 8
+	walSegmentNameWidth = 8
+)
+
+var (
+	walCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALCorrupt = errors.New("corrupt WAL record")
+)
+
+// DefaultWALConfig is the default WAL configuration, without a directory.
+var DefaultWALConfig = WALConfig{
+	SegmentSize: 8 * 1024 * 1024,
+	MinBackoff:  100 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+}
+
+// WALConfig configures the on-disk write-ahead log of a queue writer.
+//
+// Appended series are fsynced to segment files before Append returns, and a
+// segment is deleted once all its series have been written. Segments left
+// over by a previous process are replayed on startup, so series may be
+// written more than once but are not lost across restarts.
+type WALConfig struct {
+	// Dir is the directory segment files are kept in. It is created if missing.
+	Dir string `yaml:"dir"`
+
+	// SegmentSize is the size in bytes after which a new segment file is started.
+	SegmentSize int64 `yaml:"segmentSize"`
+
+	// MaxSize is the maximum total size in bytes of the segment files. Once
+	// exceeded, the oldest segments are deleted and their series dropped.
+	// Zero means no limit.
+	MaxSize int64 `yaml:"maxSize"`
+
+	// MaxAge is the maximum time since a segment was last written to before it
+	// is deleted and its series dropped. Zero means no limit.
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between attempts
+	// at writing series that failed with a recoverable error, which are retried
+	// until written rather than dropped.
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+func (c WALConfig) validate() error {
+	if c.Dir == "" {
+		return errors.New("WAL directory should not be blank")
+	}
+
+	if c.SegmentSize <= 0 {
+		return fmt.Errorf("WAL segment size should be greater than 0: %d", c.SegmentSize)
+	}
+
+	if c.MaxSize < 0 || c.MaxAge < 0 {
+		return errors.New("WAL max size and max age should not be negative")
+	}
+
+	if c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff {
+		return errors.New("WAL backoff should be greater than 0 and max backoff not less than min backoff")
+	}
+
+	return nil
+}
+
+// walSegment tracks a segment file and the series read from it that are not written yet.
+type walSegment struct {
+	seq     int
+	size    int64
+	modTime time.Time
+
+	// read is set once all records of the segment have been read.
+	read bool
+	// outstanding is the number of series read but not written yet.
+	outstanding int
+	// dropped is set once the segment is deleted.
+	dropped bool
+}
+
+// wal is a write-ahead log of appended series made of numbered segment files.
+// Series are appended to the last segment and read back, in order, by a
+// single reader that may be behind by any number of segments.
+type wal struct {
+	cfg    WALConfig
+	logger *slog.Logger
+
+	mtx      sync.Mutex
+	segments []*walSegment
+	head     *os.File
+	// headDirty is set when a failed append may have left partial bytes in the head.
+	headDirty bool
+
+	// readSeg and readOff are the position of the reader.
+	readSeg  *walSegment
+	readFile *os.File
+	readOff  int64
+
+	// consumed is the position up to which the reader has handed off series.
+	consumed walPosition
+
+	// appended is signalled when records are appended.
+	appended chan struct{}
+	// progress is closed and replaced whenever the reader advances.
+	progress chan struct{}
+}
+
+// walPosition is a position in the WAL.
+type walPosition struct {
+	seq int
+	off int64
+}
+
+func openWAL(cfg WALConfig, logger *slog.Logger) (*wal, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o777); err != nil {
+		return nil, fmt.Errorf("unable to create WAL directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read WAL directory: %v", err)
+	}
+
+	w := &wal{
+		cfg:      cfg,
+		logger:   logger,
+		appended: make(chan struct{}, 1),
+		progress: make(chan struct{}),
+	}
+
+	for _, entry := range entries {
+		seq, err := strconv.Atoi(entry.Name())
+		if err != nil || len(entry.Name()) != walSegmentNameWidth || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat WAL segment: %v", err)
+		}
+		w.segments = append(w.segments, &walSegment{seq: seq, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].seq < w.segments[j].seq })
+
+	// Series are always appended to a new segment, so that a torn record at
+	// the end of a segment left over by a previous process is never followed
+	// by valid ones.
+	seq := 0
+	if len(w.segments) > 0 {
+		seq = w.segments[len(w.segments)-1].seq + 1
+	}
+	if err := w.newHead(seq); err != nil {
+		return nil, err
+	}
+
+	w.mtx.Lock()
+	w.enforceLimits()
+	w.readSeg = w.segments[0]
+	w.consumed = walPosition{seq: w.readSeg.seq}
+	w.mtx.Unlock()
+
+	return w, nil
+}
+
+func (w *wal) segmentPath(seq int) string {
+	return filepath.Join(w.cfg.Dir, fmt.Sprintf("%0*d", walSegmentNameWidth, seq))
+}
+
+// newHead starts a new segment to append to.
+func (w *wal) newHead(seq int) error {
+	f, err := os.OpenFile(w.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+	if err != nil {
+		return fmt.Errorf("unable to create WAL segment: %v", err)
+	}
+	if err := syncDir(w.cfg.Dir); err != nil {
+		f.Close()
+		os.Remove(w.segmentPath(seq))
+		return fmt.Errorf("unable to sync WAL directory: %v", err)
+	}
+
+	if w.head != nil {
+		w.head.Close()
+	}
+	w.head = f
+	w.segments = append(w.segments, &walSegment{seq: seq, modTime: time.Now()})
+
+	return nil
+}
+
+// append writes the series as a single record and syncs it to disk.
+func (w *wal) append(series TSList) error {
+	rec, err := encodeWALRecord(series)
+	if err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.head == nil {
+		return ErrQueueClosed
+	}
+
+	if w.headDirty {
+		if err := w.recoverHead(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeRecord(rec); err != nil {
+		w.headDirty = true
+		w.recoverHead()
+		return err
+	}
+
+	head := w.segments[len(w.segments)-1]
+	head.size += int64(len(rec))
+	head.modTime = time.Now()
+
+	if head.size >= w.cfg.SegmentSize {
+		if err := w.newHead(head.seq + 1); err != nil {
+			return err
+		}
+	}
+
+	w.enforceLimits()
+
+	select {
+	case w.appended <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (w *wal) writeRecord(rec []byte) error {
+	if _, err := w.head.Write(rec); err != nil {
+		return fmt.Errorf("unable to write WAL record: %v", err)
+	}
+	if err := w.head.Sync(); err != nil {
+		return fmt.Errorf("unable to sync WAL segment: %v", err)
+	}
+
+	return nil
+}
+
+// recoverHead discards the bytes a failed append may have left after the last
+// complete record of the head, so that later records are where the reader
+// expects them. If they cannot be truncated away, appends move on to a new
+// segment, whose reader stops at the end of the complete records of the old one.
+func (w *wal) recoverHead() error {
+	head := w.segments[len(w.segments)-1]
+
+	err := w.head.Truncate(head.size)
+	if err == nil {
+		_, err = w.head.Seek(head.size, io.SeekStart)
+	}
+	if err == nil {
+		err = w.head.Sync()
+	}
+	if err != nil {
+		if err := w.newHead(head.seq + 1); err != nil {
+			return err
+		}
+	}
+
+	w.headDirty = false
+	return nil
+}
+
+// next returns the next series read from the WAL, the segment they were read
+// from and the position after them, blocking until records are appended or
+// stop is closed. The position should be passed to consume once the series
+// have been handed off.
+func (w *wal) next(stop <-chan struct{}) (TSList, *walSegment, walPosition, bool) {
+	for {
+		w.mtx.Lock()
+		series, seg, err := w.readLocked()
+		pos := walPosition{seq: w.readSeg.seq, off: w.readOff}
+		w.mtx.Unlock()
+
+		if err == nil {
+			return series, seg, pos, true
+		}
+
+		select {
+		case <-w.appended:
+		case <-stop:
+			return nil, nil, walPosition{}, false
+		}
+	}
+}
+
+// consume records that the series read up to the position have been handed off.
+func (w *wal) consume(pos walPosition) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.consumed = pos
+	w.advanced()
+}
+
+// readLocked reads the next record, moving on to the next segment at the end
+// of one. It returns io.EOF once the reader has caught up with the head.
+func (w *wal) readLocked() (TSList, *walSegment, error) {
+	for {
+		seg := w.readSeg
+
+		if seg.dropped {
+			w.moveReader(seg)
+			continue
+		}
+
+		if w.readFile == nil {
+			f, err := os.Open(w.segmentPath(seg.seq))
+			if err != nil {
+				// The segment cannot be read, so its series are lost.
+				w.logger.Error("Dropped unreadable WAL segment", "segment", seg.seq, "err", err)
+				w.finishRead(seg)
+				continue
+			}
+			w.readFile = f
+		}
+
+		series, n, err := readWALRecord(w.readFile, w.readOff, seg.size)
+		if err == nil {
+			w.readOff += n
+			seg.outstanding += len(series)
+			w.advanced()
+			return series, seg, nil
+		}
+
+		// Only complete records are accounted for in the size of the head,
+		// so the end of the head is never torn.
+		if seg == w.segments[len(w.segments)-1] {
+			return nil, nil, io.EOF
+		}
+
+		// A corrupt or torn record ends the segment early.
+		if err != io.EOF {
+			w.logger.Warn("Dropped the rest of a corrupt WAL segment", "segment", seg.seq, "offset", w.readOff, "err", err)
+		}
+		w.finishRead(seg)
+	}
+}
+
+// finishRead marks the segment read and moves the reader to the next one.
+func (w *wal) finishRead(seg *walSegment) {
+	seg.read = true
+	w.moveReader(seg)
+	w.deleteIfWritten(seg)
+}
+
+// moveReader moves the reader to the first segment after seg.
+func (w *wal) moveReader(seg *walSegment) {
+	if w.readFile != nil {
+		w.readFile.Close()
+		w.readFile = nil
+	}
+	w.readOff = 0
+
+	for _, s := range w.segments {
+		if s.seq > seg.seq {
+			w.readSeg = s
+			w.consumed = walPosition{seq: s.seq}
+			break
+		}
+	}
+	w.advanced()
+}
+
+func (w *wal) advanced() {
+	close(w.progress)
+	w.progress = make(chan struct{})
+}
+
+// position returns the position of the end of the WAL.
+func (w *wal) position() walPosition {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	head := w.segments[len(w.segments)-1]
+	return walPosition{seq: head.seq, off: head.size}
+}
+
+// consumedUpTo returns whether the series before the position have been
+// handed off, along with a channel closed when the reader next advances.
+func (w *wal) consumedUpTo(pos walPosition) (bool, <-chan struct{}) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	consumed := w.consumed.seq > pos.seq || (w.consumed.seq == pos.seq && w.consumed.off >= pos.off)
+	return consumed, w.progress
+}
+
+// ack records that n series read from the segment have been written.
+func (w *wal) ack(seg *walSegment, n int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	seg.outstanding -= n
+	w.deleteIfWritten(seg)
+}
+
+func (w *wal) deleteIfWritten(seg *walSegment) {
+	if seg.read && seg.outstanding == 0 {
+		w.deleteSegment(seg)
+	}
+}
+
+func (w *wal) deleteSegment(seg *walSegment) {
+	if seg.dropped || seg == w.segments[len(w.segments)-1] {
+		return
+	}
+
+	seg.dropped = true
+	os.Remove(w.segmentPath(seg.seq))
+	syncDir(w.cfg.Dir)
+
+	for i, s := range w.segments {
+		if s == seg {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+// enforceLimits deletes the oldest segments, other than the head, while the
+// WAL is over its size limit or they are older than its age limit.
+func (w *wal) enforceLimits() {
+	for len(w.segments) > 1 {
+		oldest := w.segments[0]
+
+		var size int64
+		for _, s := range w.segments {
+			size += s.size
+		}
+
+		overSize := w.cfg.MaxSize > 0 && size > w.cfg.MaxSize
+		overAge := w.cfg.MaxAge > 0 && time.Since(oldest.modTime) > w.cfg.MaxAge
+		if !overSize && !overAge {
+			return
+		}
+
+		if !oldest.read || oldest.outstanding > 0 {
+			w.logger.Warn("Dropped WAL segment over the WAL limits", "segment", oldest.seq, "size", size, "max_size", w.cfg.MaxSize, "max_age", w.cfg.MaxAge)
+		}
+		w.deleteSegment(oldest)
+	}
+}
+
+// checkLimits applies the size and age limits of the WAL.
+func (w *wal) checkLimits() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.enforceLimits()
+}
+
+// close closes the segment files; segments with series not written yet are kept.
+func (w *wal) close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.readFile != nil {
+		w.readFile.Close()
+		w.readFile = nil
+	}
+
+	if w.head == nil {
+		return nil
+	}
+
+	err := w.head.Close()
+	w.head = nil
+
+	// Nothing is appended to the head anymore, so it can be deleted like any
+	// other segment once all its series have been written.
+	head := w.segments[len(w.segments)-1]
+	if w.consumed.seq > head.seq || (w.consumed.seq == head.seq && w.consumed.off >= head.size) {
+		head.read = true
+	}
+	if head.read && head.outstanding == 0 {
+		head.dropped = true
+		os.Remove(w.segmentPath(head.seq))
+		syncDir(w.cfg.Dir)
+	}
+
+	return err
+}
+
+// syncDir fsyncs the directory, so that segment files created or deleted in
+// it stay so after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// encodeWALRecord encodes series as a length and checksum prefixed,
+// snappy-compressed Remote Write 2.0 request.
+func encodeWALRecord(series TSList) ([]byte, error) {
+	req, err := series.toWriteV2Request()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal protobuf: %v", err)
+	}
+
+	payload := snappy.Encode(nil, data)
+	rec := make([]byte, walRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(payload, walCastagnoli))
+	copy(rec[walRecordHeaderSize:], payload)
+
+	return rec, nil
+}
+
+// readWALRecord reads the record at the offset of a segment of the given size,
+// returning the series and the size of the record.
+func readWALRecord(f *os.File, off, size int64) (TSList, int64, error) {
+	if off == size {
+		return nil, 0, io.EOF
+	}
+	if size-off < walRecordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	var header [walRecordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > size-off-walRecordHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+walRecordHeaderSize); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+	if crc32.Checksum(payload, walCastagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errWALCorrupt
+	}
+
+	data, err := snappy.Decode(nil, payload)
+	if err != nil {
+		return nil, 0, errWALCorrupt
+	}
+
+	req := &writev2.Request{}
+	if err := req.Unmarshal(data); err != nil {
+		return nil, 0, errWALCorrupt
+	}
+
+	return fromWriteV2Request(req), walRecordHeaderSize + length, nil
+}
+
+// unexpectedEOF turns the io.EOF of a short read within a record into
+// io.ErrUnexpectedEOF, leaving io.EOF to the clean end of a segment.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
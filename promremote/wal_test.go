@@ -0,0 +1,408 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testWALConfig(t *testing.T) *WALConfig {
+	cfg := DefaultWALConfig
+	cfg.Dir = t.TempDir()
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 10 * time.Millisecond
+
+	return &cfg
+}
+
+func testWALQueueConfig(wal *WALConfig) QueueConfig {
+	cfg := DefaultQueueConfig
+	cfg.MaxShards = cfg.MinShards
+	cfg.BatchSendDeadline = 10 * time.Millisecond
+	cfg.WAL = wal
+
+	return cfg
+}
+
+func walSegmentFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestWALRecordRoundTrip(t *testing.T) {
+	ms := time.UnixMilli(nowMillis)
+	tsList := TSList{
+		{
+			Labels: []Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+			Datapoints: []Datapoint{
+				{
+					Timestamp: ms,
+					Value:     1,
+					Exemplars: []Exemplar{{Labels: []Label{{Name: "trace_id", Value: "abc"}}, Value: 1, Timestamp: ms}},
+				},
+				{Timestamp: ms.Add(time.Second), Value: 2},
+			},
+			Metadata:         Metadata{Type: MetricTypeCounter, Help: "Total HTTP requests."},
+			CreatedTimestamp: ms.Add(-time.Hour),
+		},
+		{
+			Labels:    []Label{{Name: "__name__", Value: "up"}},
+			Datapoint: Datapoint{Timestamp: ms, Value: 1},
+		},
+		{
+			Labels: []Label{{Name: "__name__", Value: "rpc_duration_seconds"}},
+			Histograms: []HistogramDatapoint{{
+				Timestamp: ms,
+				Histogram: &histogram.Histogram{
+					Schema:          1,
+					Count:           3,
+					Sum:             1.5,
+					PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+					PositiveBuckets: []int64{1, 1},
+					NegativeSpans:   []histogram.Span{},
+				},
+			}},
+		},
+	}
+
+	rec, err := encodeWALRecord(tsList)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "00000000")
+	require.NoError(t, os.WriteFile(path, append(rec, rec[:5]...), 0o666))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	decoded, n, err := readWALRecord(f, 0, int64(len(rec)+5))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(rec)), n)
+	assert.Equal(t, tsList, decoded)
+
+	// A torn record is reported as such.
+	_, _, err = readWALRecord(f, n, int64(len(rec)+5))
+	assert.Error(t, err)
+}
+
+func TestQueueWriterWAL(t *testing.T) {
+	walCfg := testWALConfig(t)
+	c := &recordingClient{}
+
+	q, err := NewQueueWriter(c, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	require.NoError(t, q.Append(testSeries("c", 3)))
+	require.NoError(t, q.Flush(context.Background()))
+
+	var written TSList
+	for _, batch := range c.written() {
+		written = append(written, batch...)
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, seriesNames(written))
+
+	require.NoError(t, q.Close(context.Background()))
+	assert.Empty(t, walSegmentFiles(t, walCfg.Dir))
+}
+
+func TestQueueWriterWALReplaysAfterOutage(t *testing.T) {
+	walCfg := testWALConfig(t)
+
+	var attempts atomic.Int32
+	down := &recordingClient{
+		writeFn: func(ctx context.Context, ts TSList) WriteError {
+			attempts.Add(1)
+			return writeError{err: context.DeadlineExceeded, code: http.StatusServiceUnavailable, recoverable: true}
+		},
+	}
+
+	q, err := NewQueueWriter(down, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2)))
+	require.NoError(t, q.Append(testSeries("c", 3)))
+
+	require.Eventually(t, func() bool { return attempts.Load() > 2 }, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.Close(ctx), context.DeadlineExceeded)
+	assert.Empty(t, down.written())
+	assert.NotEmpty(t, walSegmentFiles(t, walCfg.Dir))
+
+	// A new queue replays the series left in the WAL.
+	up := &recordingClient{}
+	q, err = NewQueueWriter(up, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+	require.NoError(t, q.Append(testSeries("d", 4)))
+	require.NoError(t, q.Close(context.Background()))
+
+	var written TSList
+	for _, batch := range up.written() {
+		written = append(written, batch...)
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, seriesNames(written))
+	assert.Empty(t, walSegmentFiles(t, walCfg.Dir))
+}
+
+func TestQueueWriterWALDropsUnrecoverable(t *testing.T) {
+	walCfg := testWALConfig(t)
+
+	var attempts atomic.Int32
+	c := &recordingClient{
+		writeFn: func(ctx context.Context, ts TSList) WriteError {
+			attempts.Add(1)
+			return writeError{err: context.DeadlineExceeded, code: http.StatusBadRequest}
+		},
+	}
+
+	q, err := NewQueueWriter(c, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1)))
+	require.NoError(t, q.Close(context.Background()))
+
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.Empty(t, walSegmentFiles(t, walCfg.Dir))
+}
+
+func TestWALSkipsTornRecords(t *testing.T) {
+	walCfg := testWALConfig(t)
+
+	rec, err := encodeWALRecord(TSList{testSeries("a", 1)})
+	require.NoError(t, err)
+	torn, err := encodeWALRecord(TSList{testSeries("b", 2)})
+	require.NoError(t, err)
+
+	data := append(rec, torn[:len(torn)-3]...)
+	require.NoError(t, os.WriteFile(filepath.Join(walCfg.Dir, "00000007"), data, 0o666))
+
+	c := &recordingClient{}
+	q, err := NewQueueWriter(c, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+	require.NoError(t, q.Append(testSeries("c", 3)))
+	require.NoError(t, q.Close(context.Background()))
+
+	var written TSList
+	for _, batch := range c.written() {
+		written = append(written, batch...)
+	}
+	assert.ElementsMatch(t, []string{"a", "c"}, seriesNames(written))
+	assert.Empty(t, walSegmentFiles(t, walCfg.Dir))
+}
+
+func TestWALLimits(t *testing.T) {
+	walCfg := testWALConfig(t)
+	walCfg.SegmentSize = 1
+	walCfg.MaxSize = 200
+
+	w, err := openWAL(*walCfg, loggerOrDiscard(nil))
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.append(TSList{testSeries("a", float64(i))}))
+	}
+
+	// Every record is in its own segment; the oldest ones were deleted.
+	files := walSegmentFiles(t, walCfg.Dir)
+	assert.Less(t, len(files), 20)
+	assert.Equal(t, "00000020", files[len(files)-1])
+
+	var size int64
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(walCfg.Dir, name))
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	assert.LessOrEqual(t, size, walCfg.MaxSize)
+
+	// The reader skips the deleted segments.
+	series, _, _, ok := w.next(nil)
+	require.True(t, ok)
+	assert.NotEqual(t, float64(0), series[0].Datapoint.Value)
+	require.NoError(t, w.close())
+
+	// Segments older than the max age are deleted on open.
+	old := time.Now().Add(-time.Hour)
+	for _, name := range walSegmentFiles(t, walCfg.Dir) {
+		require.NoError(t, os.Chtimes(filepath.Join(walCfg.Dir, name), old, old))
+	}
+	walCfg.MaxAge = time.Minute
+
+	w, err = openWAL(*walCfg, loggerOrDiscard(nil))
+	require.NoError(t, err)
+	assert.Len(t, walSegmentFiles(t, walCfg.Dir), 1)
+	require.NoError(t, w.close())
+}
+
+func TestQueueWriterWALLogsAbortedSeries(t *testing.T) {
+	walCfg := testWALConfig(t)
+
+	var attempts atomic.Int32
+	down := &recordingClient{
+		writeFn: func(ctx context.Context, ts TSList) WriteError {
+			attempts.Add(1)
+			return writeError{err: context.DeadlineExceeded, code: http.StatusServiceUnavailable, recoverable: true}
+		},
+	}
+
+	logger, records := newRecordingLogger()
+	cfg := testWALQueueConfig(walCfg)
+	cfg.MaxSamplesPerSend = 1
+	cfg.Logger = logger
+	q, err := NewQueueWriter(down, cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1), testSeries("b", 2), testSeries("c", 3)))
+	require.Eventually(t, func() bool { return attempts.Load() > 1 }, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.Close(ctx), context.DeadlineExceeded)
+
+	left := 0
+	for _, r := range records() {
+		assert.NotEqual(t, "Dropped queued series after writes were aborted", r.msg)
+		if r.msg == "Left queued series in the WAL after writes were aborted" {
+			left++
+		}
+	}
+	assert.NotZero(t, left)
+}
+
+func TestQueueWriterWALTinyMaxAge(t *testing.T) {
+	walCfg := testWALConfig(t)
+	walCfg.MaxAge = 5
+
+	q, err := NewQueueWriter(&recordingClient{}, testWALQueueConfig(walCfg))
+	require.NoError(t, err)
+
+	require.NoError(t, q.Append(testSeries("a", 1)))
+	require.NoError(t, q.Close(context.Background()))
+}
+
+func TestValidateWALConfig(t *testing.T) {
+	valid := DefaultWALConfig
+	valid.Dir = t.TempDir()
+
+	tests := []func(c *WALConfig){
+		func(c *WALConfig) { c.Dir = "" },
+		func(c *WALConfig) { c.SegmentSize = 0 },
+		func(c *WALConfig) { c.MaxSize = -1 },
+		func(c *WALConfig) { c.MinBackoff = 0 },
+		func(c *WALConfig) { c.MaxBackoff = c.MinBackoff / 2 },
+	}
+
+	for _, test := range tests {
+		walCfg := valid
+		test(&walCfg)
+
+		_, err := NewQueueWriter(&recordingClient{}, testWALQueueConfig(&walCfg))
+		require.Error(t, err)
+	}
+}
+
+func seriesNames(tsList TSList) []string {
+	names := make([]string, len(tsList))
+	for i, ts := range tsList {
+		names[i] = ts.Labels[0].Value
+	}
+
+	return names
+}
+
+func TestWALAppendFailure(t *testing.T) {
+	walCfg := testWALConfig(t)
+
+	w, err := openWAL(*walCfg, loggerOrDiscard(nil))
+	require.NoError(t, err)
+
+	require.NoError(t, w.append(TSList{testSeries("a", 1)}))
+
+	// A failed write left part of a record behind, which is truncated away.
+	_, err = w.head.Write([]byte("partial"))
+	require.NoError(t, err)
+	w.headDirty = true
+	require.NoError(t, w.append(TSList{testSeries("b", 2)}))
+
+	// The head cannot be written nor truncated, so appends move on to a new segment.
+	require.NoError(t, w.head.Close())
+	require.Error(t, w.append(TSList{testSeries("c", 3)}))
+	require.NoError(t, w.append(TSList{testSeries("d", 4)}))
+	assert.Equal(t, []string{"00000000", "00000001"}, walSegmentFiles(t, walCfg.Dir))
+
+	var read TSList
+	for len(read) < 3 {
+		series, _, pos, ok := w.next(nil)
+		require.True(t, ok)
+		w.consume(pos)
+		read = append(read, series...)
+	}
+	assert.Equal(t, []string{"a", "b", "d"}, seriesNames(read))
+	require.NoError(t, w.close())
+}
+
+func TestWALReadsSegmentsWithoutWarnings(t *testing.T) {
+	walCfg := testWALConfig(t)
+	walCfg.SegmentSize = 1
+
+	logger, records := newRecordingLogger()
+	w, err := openWAL(*walCfg, logger)
+	require.NoError(t, err)
+
+	// Every record fills a segment, so the reader reaches the end of each.
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, w.append(TSList{testSeries(name, 1)}))
+	}
+
+	var read TSList
+	for len(read) < 3 {
+		series, _, pos, ok := w.next(nil)
+		require.True(t, ok)
+		w.consume(pos)
+		read = append(read, series...)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, seriesNames(read))
+	require.NoError(t, w.close())
+
+	for _, rec := range records() {
+		assert.NotEqual(t, slog.LevelWarn, rec.level, rec.msg)
+	}
+}
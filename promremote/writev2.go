@@ -0,0 +1,294 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func (m WriteProtoMsg) validate() error {
+	switch m {
+	case "", WriteProtoMsgV1, WriteProtoMsgV2:
+		return nil
+	default:
+		return fmt.Errorf("unknown remote write protobuf message: %s", m)
+	}
+}
+
+// toWriteV2Request converts a list of timeseries to a Remote Write 2.0 proto request,
+// interning every label, help and unit string into the request symbol table.
+func (t TSList) toWriteV2Request() (*writev2.Request, error) {
+	symbols := writev2.NewSymbolTable()
+	v2TS := make([]writev2.TimeSeries, len(t))
+
+	for i, ts := range t {
+		refs := make([]uint32, 0, 2*len(ts.Labels))
+		for _, label := range ts.Labels {
+			refs = append(refs, symbols.Symbolize(label.Name), symbols.Symbolize(label.Value))
+		}
+
+		datapoints := ts.datapoints()
+		samples := make([]writev2.Sample, len(datapoints))
+		for j, dp := range datapoints {
+			samples[j] = writev2.Sample{
+				Value:     dp.Value,
+				Timestamp: toMillis(dp.Timestamp),
+			}
+		}
+
+		hDatapoints, err := ts.histograms()
+		if err != nil {
+			return nil, err
+		}
+		var histograms []writev2.Histogram
+		for _, hdp := range hDatapoints {
+			if hdp.Histogram != nil {
+				histograms = append(histograms, writev2.FromIntHistogram(toMillis(hdp.Timestamp), hdp.Histogram))
+			} else {
+				histograms = append(histograms, writev2.FromFloatHistogram(toMillis(hdp.Timestamp), hdp.FloatHistogram))
+			}
+		}
+
+		var exemplars []writev2.Exemplar
+		for _, e := range seriesExemplars(datapoints, hDatapoints) {
+			exemplarRefs := make([]uint32, 0, 2*len(e.Labels))
+			for _, label := range e.Labels {
+				exemplarRefs = append(exemplarRefs, symbols.Symbolize(label.Name), symbols.Symbolize(label.Value))
+			}
+			exemplars = append(exemplars, writev2.Exemplar{
+				LabelsRefs: exemplarRefs,
+				Value:      e.Value,
+				Timestamp:  toMillis(e.Timestamp),
+			})
+		}
+
+		v2TS[i] = writev2.TimeSeries{
+			LabelsRefs: refs,
+			Samples:    samples,
+			Histograms: histograms,
+			Exemplars:  exemplars,
+			Metadata: writev2.Metadata{
+				Type:    ts.Metadata.Type.toWriteV2(),
+				HelpRef: symbols.Symbolize(ts.Metadata.Help),
+				UnitRef: symbols.Symbolize(ts.Metadata.Unit),
+			},
+		}
+		if !ts.CreatedTimestamp.IsZero() {
+			v2TS[i].CreatedTimestamp = toMillis(ts.CreatedTimestamp)
+		}
+	}
+
+	return &writev2.Request{
+		Symbols:    symbols.Symbols(),
+		Timeseries: v2TS,
+	}, nil
+}
+
+// fromWriteV2Request converts a Remote Write 2.0 proto request back to a list of
+// timeseries. Exemplars are attached to the first datapoint of their series.
+func fromWriteV2Request(req *writev2.Request) TSList {
+	tsList := make(TSList, len(req.Timeseries))
+
+	for i, ts := range req.Timeseries {
+		series := TimeSeries{
+			Labels: fromPromLabels(desymbolizeLabels(ts.LabelsRefs, req.Symbols)),
+			Metadata: Metadata{
+				Type: metricTypeFromWriteV2(ts.Metadata.Type),
+				Help: req.Symbols[ts.Metadata.HelpRef],
+				Unit: req.Symbols[ts.Metadata.UnitRef],
+			},
+		}
+		if ts.CreatedTimestamp != 0 {
+			series.CreatedTimestamp = time.UnixMilli(ts.CreatedTimestamp)
+		}
+
+		for _, s := range ts.Samples {
+			series.Datapoints = append(series.Datapoints, Datapoint{
+				Timestamp: time.UnixMilli(s.Timestamp),
+				Value:     s.Value,
+			})
+		}
+		if len(series.Datapoints) == 1 {
+			series.Datapoint, series.Datapoints = series.Datapoints[0], nil
+		}
+
+		for _, h := range ts.Histograms {
+			hdp := HistogramDatapoint{Timestamp: time.UnixMilli(h.Timestamp)}
+			if h.IsFloatHistogram() {
+				hdp.FloatHistogram = h.ToFloatHistogram()
+			} else {
+				hdp.Histogram = h.ToIntHistogram()
+			}
+			series.Histograms = append(series.Histograms, hdp)
+		}
+
+		var exemplars []Exemplar
+		for _, e := range ts.Exemplars {
+			exemplars = append(exemplars, Exemplar{
+				Labels:    fromPromLabels(desymbolizeLabels(e.LabelsRefs, req.Symbols)),
+				Value:     e.Value,
+				Timestamp: time.UnixMilli(e.Timestamp),
+			})
+		}
+		switch {
+		case len(exemplars) == 0:
+		case len(series.Datapoints) > 0:
+			series.Datapoints[0].Exemplars = exemplars
+		case len(ts.Samples) == 1:
+			series.Datapoint.Exemplars = exemplars
+		case len(series.Histograms) > 0:
+			series.Histograms[0].Exemplars = exemplars
+		}
+
+		tsList[i] = series
+	}
+
+	return tsList
+}
+
+// v2ToPromWriteRequest converts a Remote Write 2.0 request to a Remote Write 1.0
+// write request, resolving label references against the request symbol table.
+// Per-series metadata becomes one metric metadata entry per metric name.
+func v2ToPromWriteRequest(req *writev2.Request) *prompb.WriteRequest {
+	promTS := make([]prompb.TimeSeries, len(req.Timeseries))
+	var metadata []prompb.MetricMetadata
+	seenMetadata := make(map[string]struct{})
+
+	for i, ts := range req.Timeseries {
+		labels := desymbolizeLabels(ts.LabelsRefs, req.Symbols)
+
+		samples := make([]prompb.Sample, len(ts.Samples))
+		for j, s := range ts.Samples {
+			samples[j] = prompb.Sample{Value: s.Value, Timestamp: s.Timestamp}
+		}
+
+		var histograms []prompb.Histogram
+		for _, h := range ts.Histograms {
+			if h.IsFloatHistogram() {
+				histograms = append(histograms, prompb.FromFloatHistogram(h.Timestamp, h.ToFloatHistogram()))
+			} else {
+				histograms = append(histograms, prompb.FromIntHistogram(h.Timestamp, h.ToIntHistogram()))
+			}
+		}
+
+		var exemplars []prompb.Exemplar
+		for _, e := range ts.Exemplars {
+			exemplars = append(exemplars, prompb.Exemplar{
+				Labels:    desymbolizeLabels(e.LabelsRefs, req.Symbols),
+				Value:     e.Value,
+				Timestamp: e.Timestamp,
+			})
+		}
+
+		promTS[i] = prompb.TimeSeries{
+			Labels:     labels,
+			Samples:    samples,
+			Histograms: histograms,
+			Exemplars:  exemplars,
+		}
+
+		name := metricFamilyName(metricName(labels), metricTypeFromWriteV2(ts.Metadata.Type))
+		if _, ok := seenMetadata[name]; ok || name == "" || ts.Metadata.Type == writev2.Metadata_METRIC_TYPE_UNSPECIFIED {
+			continue
+		}
+		seenMetadata[name] = struct{}{}
+		metadata = append(metadata, prompb.MetricMetadata{
+			// Both enums share the values of the Prometheus metric types.
+			Type:             prompb.MetricMetadata_MetricType(ts.Metadata.Type),
+			MetricFamilyName: name,
+			Help:             req.Symbols[ts.Metadata.HelpRef],
+			Unit:             req.Symbols[ts.Metadata.UnitRef],
+		})
+	}
+
+	return &prompb.WriteRequest{
+		Timeseries: promTS,
+		Metadata:   metadata,
+	}
+}
+
+// validateSymbolRefs checks that the label, exemplar and metadata references of
+// every series of the request are within its symbol table.
+func validateSymbolRefs(req *writev2.Request) error {
+	symbols := uint32(len(req.Symbols))
+	validRefs := func(refs ...uint32) bool {
+		for _, ref := range refs {
+			if ref >= symbols {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i, ts := range req.Timeseries {
+		if len(ts.LabelsRefs)%2 != 0 || !validRefs(ts.LabelsRefs...) {
+			return fmt.Errorf("series %d has invalid label refs for %d symbols: %v", i, symbols, ts.LabelsRefs)
+		}
+		if !validRefs(ts.Metadata.HelpRef, ts.Metadata.UnitRef) {
+			return fmt.Errorf("series %d has invalid metadata refs for %d symbols: help %d, unit %d",
+				i, symbols, ts.Metadata.HelpRef, ts.Metadata.UnitRef)
+		}
+		for _, e := range ts.Exemplars {
+			if len(e.LabelsRefs)%2 != 0 || !validRefs(e.LabelsRefs...) {
+				return fmt.Errorf("series %d has an exemplar with invalid label refs for %d symbols: %v", i, symbols, e.LabelsRefs)
+			}
+		}
+	}
+
+	return nil
+}
+
+func desymbolizeLabels(refs []uint32, symbols []string) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i+1 < len(refs); i += 2 {
+		labels = append(labels, prompb.Label{Name: symbols[refs[i]], Value: symbols[refs[i+1]]})
+	}
+
+	return labels
+}
+
+func fromPromLabels(promLabels []prompb.Label) []Label {
+	labels := make([]Label, len(promLabels))
+	for i, l := range promLabels {
+		labels[i] = Label{Name: l.Name, Value: l.Value}
+	}
+
+	return labels
+}
+
+func metricName(labels []prompb.Label) string {
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			return l.Value
+		}
+	}
+
+	return ""
+}
+
+// toMillis converts a time to the int milliseconds used by remote write.
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
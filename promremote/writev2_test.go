@@ -0,0 +1,307 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package promremote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromRemoteClientWriteV2(t *testing.T) {
+	created := now.Add(-time.Hour)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf;proto=io.prometheus.write.v2.Request", r.Header.Get("Content-Type"))
+		assert.Equal(t, "2.0.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+
+		req := decodeWriteRequestV2(t, r)
+
+		require.Len(t, req.Timeseries, 2)
+		assert.Equal(t, "", req.Symbols[0])
+
+		first := req.Timeseries[0]
+		require.Len(t, first.LabelsRefs, 4)
+		assert.Equal(t, "__name__", req.Symbols[first.LabelsRefs[0]])
+		assert.Equal(t, "foo_bar", req.Symbols[first.LabelsRefs[1]])
+		assert.Equal(t, "biz", req.Symbols[first.LabelsRefs[2]])
+		assert.Equal(t, "baz", req.Symbols[first.LabelsRefs[3]])
+		require.Len(t, first.Samples, 1)
+		assert.Equal(t, 1415.92, first.Samples[0].Value)
+		assert.Equal(t, nowMillis, first.Samples[0].Timestamp)
+		assert.Equal(t, writev2.Metadata_METRIC_TYPE_COUNTER, first.Metadata.Type)
+		assert.Equal(t, "Foo bar help", req.Symbols[first.Metadata.HelpRef])
+		assert.Equal(t, "", req.Symbols[first.Metadata.UnitRef])
+		assert.Equal(t, created.UnixNano()/int64(time.Millisecond), first.CreatedTimestamp)
+
+		// Label names and values shared between series are interned once.
+		second := req.Timeseries[1]
+		assert.Equal(t, first.LabelsRefs[0], second.LabelsRefs[0])
+		assert.Equal(t, first.LabelsRefs[2], second.LabelsRefs[2])
+		assert.Equal(t, first.LabelsRefs[3], second.LabelsRefs[3])
+		assert.Equal(t, "foo_baz", req.Symbols[second.LabelsRefs[1]])
+		assert.Equal(t, writev2.Metadata_METRIC_TYPE_UNSPECIFIED, second.Metadata.Type)
+		assert.Equal(t, int64(0), second.CreatedTimestamp)
+		assert.Len(t, req.Symbols, 7)
+	}))
+
+	defer testServer.Close()
+
+	cfg := NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+	)
+
+	c, err := NewClient(cfg)
+	require.NoError(t, err)
+
+	tsList := TSList{
+		{
+			Labels: []Label{
+				{Name: "__name__", Value: "foo_bar"},
+				{Name: "biz", Value: "baz"},
+			},
+			Datapoint: Datapoint{
+				Timestamp: now,
+				Value:     1415.92,
+			},
+			Metadata: Metadata{
+				Type: MetricTypeCounter,
+				Help: "Foo bar help",
+			},
+			CreatedTimestamp: created,
+		},
+		{
+			Labels: []Label{
+				{Name: "__name__", Value: "foo_baz"},
+				{Name: "biz", Value: "baz"},
+			},
+			Datapoint: Datapoint{
+				Timestamp: now,
+				Value:     3.14,
+			},
+		},
+	}
+
+	r, err := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestPromRemoteClientWriteV1VersionHeader(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	}))
+
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(WriteURLOption(testServer.URL)))
+	require.NoError(t, err)
+
+	_, err = c.WriteTimeSeries(context.Background(), TSList{{
+		Labels:    []Label{{Name: "__name__", Value: "foo_bar"}},
+		Datapoint: Datapoint{Timestamp: now, Value: 1},
+	}}, WriteOptions{})
+	require.NoError(t, err)
+}
+
+func TestPromRemoteClientWriteV2FallbackOnUnsupportedMediaType(t *testing.T) {
+	var v1Requests, v2Requests atomic.Int32
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			v2Requests.Add(1)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		v1Requests.Add(1)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+
+		wr := decodeWriteRequest(t, r)
+
+		require.Len(t, wr.Timeseries, 1)
+		assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "foo_bar"}, {Name: "biz", Value: "baz"}},
+			wr.Timeseries[0].Labels)
+		assert.Equal(t, []prompb.Sample{{Value: 1415.92, Timestamp: nowMillis}}, wr.Timeseries[0].Samples)
+	}))
+
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+	))
+	require.NoError(t, err)
+
+	tsList := TSList{{
+		Labels: []Label{
+			{Name: "__name__", Value: "foo_bar"},
+			{Name: "biz", Value: "baz"},
+		},
+		Datapoint: Datapoint{Timestamp: now, Value: 1415.92},
+	}}
+
+	r, writeErr := c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, int32(1), v2Requests.Load())
+	assert.Equal(t, int32(1), v1Requests.Load())
+
+	// The downgrade is remembered, so later writes go straight to Remote Write 1.0.
+	_, writeErr = c.WriteTimeSeries(context.Background(), tsList, WriteOptions{})
+	require.NoError(t, writeErr)
+	v2Req, err := tsList.toWriteV2Request()
+	require.NoError(t, err)
+	_, writeErr = c.(V2Writer).WriteProtoV2(context.Background(), v2Req, WriteOptions{})
+	require.NoError(t, writeErr)
+	assert.Equal(t, int32(1), v2Requests.Load())
+	assert.Equal(t, int32(3), v1Requests.Load())
+}
+
+func TestPromRemoteClientWriteV2InvalidSymbolRefs(t *testing.T) {
+	var requests atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer testServer.Close()
+
+	c, err := NewClient(NewConfig(
+		WriteURLOption(testServer.URL),
+		WriteProtoMsgOption(WriteProtoMsgV2),
+		ExternalLabelsOption(map[string]string{"cluster": "eu-1"}),
+	))
+	require.NoError(t, err)
+
+	tests := []writev2.TimeSeries{
+		{LabelsRefs: []uint32{0, 5}},
+		{LabelsRefs: []uint32{0, 1, 0}},
+		{LabelsRefs: []uint32{0, 1}, Metadata: writev2.Metadata{HelpRef: 2}},
+		{LabelsRefs: []uint32{0, 1}, Exemplars: []writev2.Exemplar{{LabelsRefs: []uint32{1, 7}}}},
+	}
+
+	for _, ts := range tests {
+		req := &writev2.Request{Symbols: []string{"__name__", "foo_bar"}, Timeseries: []writev2.TimeSeries{ts}}
+		_, writeErr := c.(V2Writer).WriteProtoV2(context.Background(), req, WriteOptions{})
+		require.Error(t, writeErr, "%+v", ts)
+		assert.Equal(t, 0, writeErr.StatusCode())
+	}
+	assert.Equal(t, int32(0), requests.Load())
+}
+
+func TestV2ToPromWriteRequest(t *testing.T) {
+	h := &histogram.Histogram{
+		CounterResetHint: histogram.NotCounterReset,
+		Schema:           2,
+		ZeroThreshold:    0.001,
+		ZeroCount:        1,
+		Count:            6,
+		Sum:              12.5,
+		PositiveSpans:    []histogram.Span{{Offset: 0, Length: 2}},
+		PositiveBuckets:  []int64{2, 1},
+		NegativeSpans:    []histogram.Span{{Offset: 1, Length: 1}},
+		NegativeBuckets:  []int64{0},
+	}
+
+	req := &writev2.Request{
+		Symbols: []string{"", "__name__", "rpc_duration_seconds", "job", "api", "trace_id", "abc", "RPC latency", "seconds"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Histograms: []writev2.Histogram{writev2.FromIntHistogram(nowMillis, h)},
+				Exemplars:  []writev2.Exemplar{{LabelsRefs: []uint32{5, 6}, Value: 0.2, Timestamp: nowMillis}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_HISTOGRAM, HelpRef: 7, UnitRef: 8},
+			},
+			{
+				LabelsRefs: []uint32{1, 2, 3, 6},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: nowMillis}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_HISTOGRAM, HelpRef: 7, UnitRef: 8},
+			},
+		},
+	}
+
+	wr := v2ToPromWriteRequest(req)
+
+	require.Len(t, wr.Timeseries, 2)
+	assert.Equal(t, []prompb.Label{{Name: "__name__", Value: "rpc_duration_seconds"}, {Name: "job", Value: "api"}},
+		wr.Timeseries[0].Labels)
+	require.Len(t, wr.Timeseries[0].Histograms, 1)
+	assert.Equal(t, h, wr.Timeseries[0].Histograms[0].ToIntHistogram())
+	assert.Equal(t, nowMillis, wr.Timeseries[0].Histograms[0].Timestamp)
+	assert.Equal(t, []prompb.Exemplar{{
+		Labels:    []prompb.Label{{Name: "trace_id", Value: "abc"}},
+		Value:     0.2,
+		Timestamp: nowMillis,
+	}}, wr.Timeseries[0].Exemplars)
+	assert.Equal(t, []prompb.Sample{{Value: 1, Timestamp: nowMillis}}, wr.Timeseries[1].Samples)
+
+	// Series sharing a metric name produce a single metadata entry.
+	assert.Equal(t, []prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_HISTOGRAM,
+		MetricFamilyName: "rpc_duration_seconds",
+		Help:             "RPC latency",
+		Unit:             "seconds",
+	}}, wr.Metadata)
+}
+
+func TestValidateConfigWriteProtoMsg(t *testing.T) {
+	_, err := NewClient(NewConfig(WriteProtoMsgOption("prometheus.Unknown")))
+	require.Error(t, err)
+
+	_, err = NewClient(NewConfig(WriteProtoMsgOption(WriteProtoMsgV2)))
+	require.NoError(t, err)
+}
+
+func TestV2ToPromWriteRequestClassicHistogramMetadata(t *testing.T) {
+	req := &writev2.Request{
+		Symbols: []string{"", "__name__", "rpc_duration_seconds_bucket", "rpc_duration_seconds_sum", "le", "+Inf", "RPC latency"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 4, 5},
+				Samples:    []writev2.Sample{{Value: 3, Timestamp: nowMillis}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_HISTOGRAM, HelpRef: 6},
+			},
+			{
+				LabelsRefs: []uint32{1, 3},
+				Samples:    []writev2.Sample{{Value: 1.5, Timestamp: nowMillis}},
+				Metadata:   writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_HISTOGRAM, HelpRef: 6},
+			},
+		},
+	}
+
+	// Metadata is keyed by the metric family, not the names of its series.
+	assert.Equal(t, []prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_HISTOGRAM,
+		MetricFamilyName: "rpc_duration_seconds",
+		Help:             "RPC latency",
+	}}, v2ToPromWriteRequest(req).Metadata)
+}